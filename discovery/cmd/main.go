@@ -2,111 +2,389 @@ package main
 
 import (
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/docker-router/discovery/pkg/auth"
+	"github.com/docker-router/discovery/pkg/backend"
+	"github.com/docker-router/discovery/pkg/dnssrv"
+	"github.com/docker-router/discovery/pkg/gossip"
 	"github.com/docker-router/discovery/pkg/multicast"
+	"github.com/docker-router/discovery/pkg/netutil"
+	"github.com/docker-router/discovery/pkg/protocol"
+	"github.com/docker-router/discovery/pkg/ratelimit"
+	"github.com/docker-router/discovery/pkg/static"
 	"github.com/docker-router/discovery/pkg/storage"
+	"github.com/docker-router/discovery/pkg/unicast"
+)
+
+// Discovery modes selectable with DISCOVERY_MODE; several can be combined
+// as a comma-separated list
+const (
+	ModeMulticast = "multicast"
+	ModeUnicast   = "unicast"
+	ModeStatic    = "static"
+	ModeDNS       = "dns"
 )
 
 func main() {
 	log.SetOutput(os.Stdout)
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	
+
 	log.Println("Starting Docker Router Discovery Service")
-	
+
 	// Read configuration from environment variables
 	config := readConfig()
-	
-	// Initialize storage
-	storage := storage.NewFileStorage(config.DataDir)
-	if err := storage.Initialize(); err != nil {
-		log.Fatalf("Failed to initialize storage: %v", err)
-	}
-	
-	// Create discovery instance
-	discovery := multicast.NewDiscovery(config.StackID, config.VNI, storage)
-	
-	// Configure discovery
-	if config.MulticastGroup != "" {
-		discovery.SetMulticastGroup(config.MulticastGroup)
-	}
-	if config.Port != 0 {
-		discovery.SetPort(config.Port)
-	}
-	if config.AnnounceInterval != 0 {
-		discovery.SetAnnounceInterval(time.Duration(config.AnnounceInterval) * time.Second)
+
+	// Initialize one storage per VNI; a single VNI keeps the plain
+	// discovery file name
+	manager := backend.NewManager()
+	for _, vni := range config.VNIs {
+		vniStorage := storage.NewFileStorage(config.DataDir)
+		vniStorage.SetWriterID(config.StackID)
+		vniStorage.SetLocalStackID(config.StackID)
+		vniStorage.SetHistory(config.History)
+		if len(config.VNIs) > 1 {
+			vniStorage.SetFileName(storage.VNIDiscoveryFile(vni))
+		}
+		if err := vniStorage.Initialize(); err != nil {
+			log.Fatalf("Failed to initialize storage: %v", err)
+		}
+		manager.AddVNI(vni, vniStorage)
 	}
+
+	// Create the backends for every selected mode
 	if config.PeerTimeout != 0 {
-		discovery.SetPeerTimeout(time.Duration(config.PeerTimeout) * time.Second)
+		manager.SetPeerTimeout(time.Duration(config.PeerTimeout) * time.Second)
+	}
+	manager.SetStaleHold(config.StaleHold)
+	manager.SetStartupGrace(config.StartupGrace)
+	manager.SetMaxPeers(config.MaxPeers)
+	manager.SetStatsFile(filepath.Join(config.DataDir, storage.StatsFileName(config.StackID)))
+	for _, mode := range config.Modes {
+		manager.Add(newBackend(mode, config))
 	}
-	
+
 	// Start discovery
-	if err := discovery.Start(); err != nil {
+	if err := manager.Start(); err != nil {
 		log.Fatalf("Failed to start discovery: %v", err)
 	}
-	
+
 	// Wait for termination signal
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	
+
 	log.Println("Discovery service is running. Press Ctrl+C to stop.")
 	<-sigChan
-	
+
 	log.Println("Shutting down discovery service...")
-	if err := discovery.Stop(); err != nil {
+	if err := manager.Stop(); err != nil {
 		log.Printf("Error stopping discovery: %v", err)
 	}
-	
+
+	for name, value := range manager.Stats() {
+		log.Printf("Counter %s=%d", name, value)
+	}
+
 	log.Println("Discovery service stopped")
 }
 
+// newBackend creates and configures the backend for a discovery mode
+func newBackend(mode string, config Config) backend.Backend {
+	switch mode {
+	case ModeMulticast:
+		discovery := multicast.NewDiscovery(config.StackID, config.VNI)
+		if config.MulticastGroup != "" {
+			discovery.SetMulticastGroup(config.MulticastGroup)
+		}
+		if config.MulticastGroup6 != "" {
+			discovery.SetMulticastGroup6(config.MulticastGroup6)
+		}
+		filter, err := netutil.NewInterfaceFilter(config.MulticastInterfaces, config.MulticastExcludeInterfaces)
+		if err != nil {
+			log.Fatalf("Invalid multicast interface selection: %v", err)
+		}
+		discovery.SetInterfaceFilter(filter)
+		if config.Port != 0 {
+			discovery.SetPort(config.Port)
+		}
+		if config.AnnounceInterval != 0 {
+			discovery.SetAnnounceInterval(time.Duration(config.AnnounceInterval) * time.Second)
+		}
+		discovery.SetStartupGrace(config.StartupGrace)
+		if config.GossipEnabled {
+			gossipConfig := gossip.DefaultConfig()
+			gossipConfig.ProbeInterval = config.GossipProbeInterval
+			gossipConfig.ProbeTimeout = config.GossipProbeTimeout
+			gossipConfig.SuspectTimeout = config.GossipSuspectTimeout
+			discovery.EnableGossip(gossipConfig)
+		}
+		configureSession(discovery.Session, config)
+		return discovery
+	case ModeUnicast:
+		seeds := unicast.ParseSeeds(config.SeedPeers, config.UnicastPort)
+		if len(seeds) == 0 {
+			log.Fatal("SEED_PEERS environment variable is required in unicast mode")
+		}
+		discovery := unicast.NewDiscovery(config.StackID, config.VNI, seeds)
+		if config.UnicastPort != 0 {
+			discovery.SetPort(config.UnicastPort)
+		}
+		if config.AnnounceInterval != 0 {
+			discovery.SetAnnounceInterval(time.Duration(config.AnnounceInterval) * time.Second)
+		}
+		if config.PeerTimeout != 0 {
+			discovery.SetPeerTimeout(time.Duration(config.PeerTimeout) * time.Second)
+		}
+		configureSession(discovery.Session, config)
+		return discovery
+	case ModeStatic:
+		staticBackend := static.NewBackend(config.StaticPeersFile, config.VNI)
+		if config.StaticRefreshInterval != 0 {
+			staticBackend.SetRefreshInterval(time.Duration(config.StaticRefreshInterval) * time.Second)
+		}
+		return staticBackend
+	case ModeDNS:
+		name := config.DNSSRVName
+		if name == "" && config.DNSDomain != "" {
+			name = dnssrv.RecordName(config.DNSDomain)
+		}
+		if name == "" {
+			log.Fatal("DNS_DOMAIN or DNS_SRV_NAME environment variable is required in dns mode")
+		}
+		dnsBackend := dnssrv.NewBackend(name, config.VNI)
+		if config.DNSUpdateInterval != 0 {
+			dnsBackend.SetRefreshInterval(time.Duration(config.DNSUpdateInterval) * time.Second)
+		}
+		return dnsBackend
+	}
+
+	log.Fatalf("Unknown discovery mode %q (expected %s, %s, %s or %s)", mode, ModeMulticast, ModeUnicast, ModeStatic, ModeDNS)
+	return nil
+}
+
+// configureSession applies the host address, advertised route and message
+// security settings to a protocol session
+func configureSession(session *protocol.Session, config Config) {
+	sourceMode, err := auth.ParseSourceMode(config.SourceCheck)
+	if err != nil {
+		log.Fatalf("Invalid SOURCE_CHECK: %v", err)
+	}
+	family, err := protocol.ParseFamily(config.IPFamily)
+	if err != nil {
+		log.Fatalf("Invalid IP_FAMILY: %v", err)
+	}
+	wireFormat, err := protocol.ParseWireFormat(config.WireFormat)
+	if err != nil {
+		log.Fatalf("Invalid WIRE_FORMAT: %v", err)
+	}
+	session.SetFamily(family)
+	session.SetDomain(config.Domain)
+	session.SetVNIs(config.VNIs)
+	session.SetHostIPConfig(config.HostIP)
+	session.SetAdvertisedRoutes(config.LocalVXLANIP, config.ContainerSubnets)
+	session.SetLabels(config.Labels)
+	session.SetWireFormat(wireFormat)
+	session.SetSourceMode(sourceMode)
+	session.SetFastAnnounceInterval(config.FastAnnounceInterval)
+	session.SetRateLimit(config.RateLimit, config.RateLimitBurst)
+	session.SetMaxClockSkew(time.Duration(config.MaxClockSkew) * time.Second)
+
+	if config.SharedSecret != "" {
+		authenticator, err := auth.NewAuthenticator(config.SharedSecret)
+		if err != nil {
+			log.Fatalf("Failed to configure authentication: %v", err)
+		}
+		if config.PreviousSecret != "" {
+			authenticator.SetPreviousKey(config.PreviousSecret, time.Duration(config.KeyRotationWindow)*time.Second)
+		}
+		session.SetAuthenticator(authenticator)
+	}
+}
+
 // Config holds the application configuration
 type Config struct {
-	StackID          string
-	VNI              int
-	DataDir          string
-	MulticastGroup   string
-	Port             int
-	AnnounceInterval int
-	PeerTimeout      int
+	StackID                    string
+	Domain                     string
+	Modes                      []string
+	SeedPeers                  string
+	StaticPeersFile            string
+	StaticRefreshInterval      int
+	DNSDomain                  string
+	DNSSRVName                 string
+	DNSUpdateInterval          int
+	VNI                        int
+	VNIs                       []int
+	DataDir                    string
+	MulticastGroup             string
+	MulticastGroup6            string
+	IPFamily                   string
+	HostIP                     netutil.HostIPConfig
+	LocalVXLANIP               string
+	ContainerSubnets           []string
+	Labels                     map[string]string
+	WireFormat                 string
+	MulticastInterfaces        []string
+	MulticastExcludeInterfaces []string
+	Port                       int
+	UnicastPort                int
+	AnnounceInterval           int
+	FastAnnounceInterval       time.Duration
+	PeerTimeout                int
+	StaleHold                  time.Duration
+	StartupGrace               time.Duration
+	SharedSecret               string
+	PreviousSecret             string
+	KeyRotationWindow          int
+	MaxClockSkew               int
+	SourceCheck                string
+	RateLimit                  float64
+	RateLimitBurst             int
+	MaxPeers                   int
+	History                    int
+	GossipEnabled              bool
+	GossipProbeInterval        time.Duration
+	GossipProbeTimeout         time.Duration
+	GossipSuspectTimeout       time.Duration
 }
 
 // readConfig reads configuration from environment variables
 func readConfig() Config {
+	// A discovery domain derives its own multicast groups and port, so
+	// independent overlays on one network are isolated by default
+	domain := getEnv("DISCOVERY_DOMAIN", "")
+	group, group6, port := multicast.DefaultMulticastGroup, multicast.DefaultMulticastGroup6, protocol.DefaultDiscoveryPort
+	if domain != "" {
+		group, group6 = protocol.DomainGroups(domain)
+		port = protocol.DomainPort(domain)
+	}
+
 	config := Config{
-		StackID:          getEnv("STACK_ID", ""),
-		DataDir:          getEnv("DATA_DIR", "/var/lib/docker-router"),
-		MulticastGroup:   getEnv("MULTICAST_GROUP", "239.1.1.1"),
-		Port:             getEnvInt("DISCOVERY_PORT", 4790),
-		AnnounceInterval: getEnvInt("ANNOUNCE_INTERVAL", 30),
-		PeerTimeout:      getEnvInt("PEER_TIMEOUT", 90),
-	}
-	
-	vniStr := getEnv("VNI", "")
-	if vniStr == "" {
+		StackID:               getEnv("STACK_ID", ""),
+		Domain:                domain,
+		Modes:                 getEnvList("DISCOVERY_MODE", ModeMulticast),
+		SeedPeers:             getEnv("SEED_PEERS", ""),
+		StaticPeersFile:       getEnv("STATIC_PEERS_FILE", static.DefaultPeersFile),
+		StaticRefreshInterval: getEnvInt("STATIC_REFRESH_INTERVAL", 30),
+		DNSDomain:             getEnv("DNS_DOMAIN", ""),
+		DNSSRVName:            getEnv("DNS_SRV_NAME", ""),
+		DNSUpdateInterval:     getEnvInt("DNS_UPDATE_INTERVAL", 30),
+		DataDir:               getEnv("DATA_DIR", "/var/lib/docker-router"),
+		MulticastGroup:        getEnv("MULTICAST_GROUP", group),
+		MulticastGroup6:       getEnv("MULTICAST_GROUP6", group6),
+		IPFamily:              getEnv("IP_FAMILY", string(protocol.FamilyIPv4)),
+		HostIP: netutil.HostIPConfig{
+			Addresses: getEnvList("HOST_IP", ""),
+			Interface: getEnv("HOST_INTERFACE", ""),
+			Route:     getEnv("HOST_ROUTE", ""),
+			Subnet:    getEnv("HOST_SUBNET", ""),
+		},
+		LocalVXLANIP:               getEnv("LOCAL_VXLAN_IP", ""),
+		ContainerSubnets:           getEnvList("CONTAINER_SUBNETS", ""),
+		Labels:                     make(map[string]string),
+		WireFormat:                 getEnv("WIRE_FORMAT", string(protocol.WireFormatAuto)),
+		MulticastInterfaces:        getEnvList("MULTICAST_INTERFACES", ""),
+		MulticastExcludeInterfaces: getEnvList("MULTICAST_EXCLUDE_INTERFACES", ""),
+		Port:                       getEnvInt("DISCOVERY_PORT", port),
+		AnnounceInterval:           getEnvInt("ANNOUNCE_INTERVAL", 30),
+		FastAnnounceInterval:       getEnvDuration("FAST_ANNOUNCE_INTERVAL", protocol.DefaultFastAnnounceInterval),
+		PeerTimeout:                getEnvInt("PEER_TIMEOUT", 90),
+		StaleHold:                  getEnvDuration("STALE_HOLD", backend.DefaultStaleHold),
+		StartupGrace:               getEnvDuration("STARTUP_GRACE", multicast.DefaultStartupGrace),
+		SharedSecret:               getEnv("DISCOVERY_SECRET", ""),
+		PreviousSecret:             getEnv("DISCOVERY_PREVIOUS_SECRET", ""),
+		KeyRotationWindow:          getEnvInt("KEY_ROTATION_WINDOW", int(auth.DefaultRotationWindow/time.Second)),
+		SourceCheck:                getEnv("SOURCE_CHECK", string(auth.SourceModeOff)),
+		RateLimit:                  getEnvFloat("RATE_LIMIT", ratelimit.DefaultRate),
+		RateLimitBurst:             getEnvInt("RATE_LIMIT_BURST", ratelimit.DefaultBurst),
+		MaxPeers:                   getEnvInt("MAX_PEERS", 0),
+		History:                    getEnvInt("DISCOVERY_HISTORY", storage.DefaultHistory),
+		MaxClockSkew:               getEnvInt("MAX_CLOCK_SKEW", int(auth.DefaultMaxClockSkew/time.Second)),
+		GossipEnabled:              getEnvBool("GOSSIP_ENABLED", false),
+		GossipProbeInterval:        getEnvDuration("GOSSIP_PROBE_INTERVAL", gossip.DefaultProbeInterval),
+		GossipProbeTimeout:         getEnvDuration("GOSSIP_PROBE_TIMEOUT", gossip.DefaultProbeTimeout),
+		GossipSuspectTimeout:       getEnvDuration("GOSSIP_SUSPECT_TIMEOUT", gossip.DefaultSuspectTimeout),
+	}
+
+	vniList := getEnvList("VNI", "")
+	if len(vniList) == 0 {
 		log.Fatal("VNI environment variable is required")
 	}
-	
-	vni, err := strconv.Atoi(vniStr)
-	if err != nil {
-		log.Fatalf("Invalid VNI value: %v", err)
+
+	seen := make(map[int]bool)
+	for _, vniStr := range vniList {
+		vni, err := strconv.Atoi(vniStr)
+		if err != nil {
+			log.Fatalf("Invalid VNI value: %v", err)
+		}
+		if !seen[vni] {
+			seen[vni] = true
+			config.VNIs = append(config.VNIs, vni)
+		}
 	}
-	config.VNI = vni
-	
+	config.VNI = config.VNIs[0]
+
+	// Unicast binds its port without address reuse, so it cannot share the
+	// multicast port
+	config.UnicastPort = getEnvInt("UNICAST_PORT", config.Port)
+	if hasMode(config.Modes, ModeMulticast) && hasMode(config.Modes, ModeUnicast) && config.UnicastPort == config.Port {
+		log.Fatalf("Multicast and unicast discovery cannot both use port %d; set UNICAST_PORT to another port", config.Port)
+	}
+
 	if config.StackID == "" {
 		log.Fatal("STACK_ID environment variable is required")
 	}
-	
-	log.Printf("Configuration: StackID=%s, VNI=%d, MulticastGroup=%s, Port=%d", 
-		config.StackID, config.VNI, config.MulticastGroup, config.Port)
-	
+
+	if config.GossipProbeTimeout >= config.GossipProbeInterval {
+		log.Fatal("GOSSIP_PROBE_TIMEOUT must be shorter than GOSSIP_PROBE_INTERVAL")
+	}
+
+	if err := config.HostIP.Validate(); err != nil {
+		log.Fatalf("Invalid host IP configuration: %v", err)
+	}
+
+	if config.LocalVXLANIP != "" && net.ParseIP(config.LocalVXLANIP) == nil {
+		log.Fatalf("Invalid LOCAL_VXLAN_IP %q", config.LocalVXLANIP)
+	}
+	for _, subnet := range config.ContainerSubnets {
+		if _, _, err := net.ParseCIDR(subnet); err != nil {
+			log.Fatalf("Invalid CONTAINER_SUBNETS entry %q: %v", subnet, err)
+		}
+	}
+	if len(config.ContainerSubnets) > 0 && config.LocalVXLANIP == "" {
+		log.Fatal("CONTAINER_SUBNETS requires LOCAL_VXLAN_IP as the next hop for them")
+	}
+
+	for _, label := range getEnvList("LABELS", "") {
+		key, value, ok := strings.Cut(label, "=")
+		if !ok || key == "" {
+			log.Fatalf("Invalid LABELS entry %q (expected key=value)", label)
+		}
+		config.Labels[key] = value
+	}
+
+	log.Printf("Configuration: StackID=%s, Domain=%q, VNIs=%v, Modes=%v, IPFamily=%s, MulticastGroup=%s, MulticastGroup6=%s, Port=%d",
+		config.StackID, config.Domain, config.VNIs, config.Modes, config.IPFamily, config.MulticastGroup, config.MulticastGroup6, config.Port)
+
 	return config
 }
 
+// hasMode reports whether mode is among the selected discovery modes
+func hasMode(modes []string, mode string) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
 // getEnv gets an environment variable with a default value
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -123,4 +401,49 @@ func getEnvInt(key string, defaultValue int) int {
 		}
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
+
+// getEnvFloat gets an environment variable as a float with a default value
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
+// getEnvList gets a comma-separated environment variable as a list
+func getEnvList(key, defaultValue string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(key, defaultValue), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getEnvBool gets an environment variable as a boolean with a default value
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
+// getEnvDuration gets an environment variable as a duration with a default
+// value. Both Go durations ("500ms", "2s") and plain integer seconds are accepted.
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		if duration, err := time.ParseDuration(value); err == nil {
+			return duration
+		}
+	}
+	return defaultValue
+}
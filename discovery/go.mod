@@ -3,6 +3,9 @@ module github.com/docker-router/discovery
 go 1.21
 
 require (
+	github.com/docker-router/schema v0.0.0
 	golang.org/x/net v0.19.0
 	golang.org/x/sys v0.15.0
-)
\ No newline at end of file
+)
+
+replace github.com/docker-router/schema => ../schema
\ No newline at end of file
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker-router/discovery/pkg/types"
+)
+
+const (
+	// NonceSize is the number of random bytes in a message nonce
+	NonceSize = 16
+	// DefaultRotationWindow is how long the previous key stays valid after a rotation
+	DefaultRotationWindow = 1 * time.Hour
+)
+
+var (
+	// ErrUnsigned is returned when a message carries no signature
+	ErrUnsigned = errors.New("message is not signed")
+	// ErrBadSignature is returned when no accepted key verifies the signature
+	ErrBadSignature = errors.New("message signature is invalid")
+)
+
+// Authenticator signs and verifies discovery messages with a shared secret.
+// During a key rotation the previous secret is still accepted for verification
+// until the rotation window closes; outgoing messages always use the current key.
+type Authenticator struct {
+	mutex         sync.RWMutex
+	current       []byte
+	previous      []byte
+	previousUntil time.Time
+}
+
+// NewAuthenticator creates an authenticator for the given shared secret
+func NewAuthenticator(secret string) (*Authenticator, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("shared secret must not be empty")
+	}
+
+	return &Authenticator{
+		current: []byte(secret),
+	}, nil
+}
+
+// SetPreviousKey accepts an older secret for verification for the given window
+func (a *Authenticator) SetPreviousKey(secret string, window time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if secret == "" {
+		a.previous = nil
+		return
+	}
+	a.previous = []byte(secret)
+	a.previousUntil = time.Now().Add(window)
+}
+
+// Rotate makes secret the signing key and keeps accepting the old key for window
+func (a *Authenticator) Rotate(secret string, window time.Duration) error {
+	if secret == "" {
+		return fmt.Errorf("shared secret must not be empty")
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.previous = a.current
+	a.previousUntil = time.Now().Add(window)
+	a.current = []byte(secret)
+	return nil
+}
+
+// SetNonce sets a fresh random nonce on a message before it is encoded and
+// signed, so replayed copies can be recognized
+func SetNonce(message *types.MulticastMessage) error {
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	message.Nonce = hex.EncodeToString(nonce)
+	return nil
+}
+
+// Sign returns the signature of an encoded message with the current key
+func (a *Authenticator) Sign(payload []byte) []byte {
+	a.mutex.RLock()
+	key := a.current
+	a.mutex.RUnlock()
+
+	return computeSignature(key, payload)
+}
+
+// Verify checks the signature of an encoded message against the current key
+// and, while the rotation window is open, the previous key. The signature
+// covers the bytes as received, so fields this version does not decode are
+// still verified.
+func (a *Authenticator) Verify(payload, signature []byte) error {
+	if len(signature) == 0 {
+		return ErrUnsigned
+	}
+
+	a.mutex.RLock()
+	keys := [][]byte{a.current}
+	if a.previous != nil && time.Now().Before(a.previousUntil) {
+		keys = append(keys, a.previous)
+	}
+	a.mutex.RUnlock()
+
+	for _, key := range keys {
+		if hmac.Equal(signature, computeSignature(key, payload)) {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+// computeSignature returns the HMAC-SHA256 of an encoded message
+func computeSignature(key, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker-router/discovery/pkg/types"
+)
+
+// DefaultMaxClockSkew is the default tolerated difference between a message
+// timestamp and the local clock
+const DefaultMaxClockSkew = 30 * time.Second
+
+const (
+	// ReplayTTL is how long nonces and sequence numbers are remembered after
+	// they were last seen, or twice the clock-skew window if that is longer
+	ReplayTTL = 5 * time.Minute
+	// MaxNonces bounds the nonce cache; the oldest nonces are evicted first
+	MaxNonces = 65536
+	// MaxSeqEntries bounds the number of peers whose sequence numbers are
+	// tracked; the least recently seen peer is evicted first
+	MaxSeqEntries = 4096
+)
+
+// Reasons a message can be rejected by the replay guard
+const (
+	ReasonStale         = "stale"
+	ReasonFuture        = "future"
+	ReasonReplayedSeq   = "replayed_seq"
+	ReasonReplayedNonce = "replayed_nonce"
+)
+
+// RejectError describes why the replay guard refused a message
+type RejectError struct {
+	Reason string
+	Detail string
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Detail)
+}
+
+// SeqWindow is how far below the highest sequence number a message may
+// arrive out of order and still be accepted once
+const SeqWindow = 64
+
+// seqEntry tracks the sequence numbers seen from a peer as the highest one
+// plus a bitmap of the SeqWindow numbers below it
+type seqEntry struct {
+	highest  uint64
+	window   uint64
+	lastSeen time.Time
+}
+
+// accept records seq and reports whether it had not been seen before
+func (e *seqEntry) accept(seq uint64) bool {
+	if seq > e.highest {
+		shift := seq - e.highest
+		if shift >= SeqWindow {
+			e.window = 0
+		} else {
+			e.window <<= shift
+		}
+		e.window |= 1
+		e.highest = seq
+		return true
+	}
+
+	diff := e.highest - seq
+	if diff >= SeqWindow || e.window&(1<<diff) != 0 {
+		return false
+	}
+	e.window |= 1 << diff
+	return true
+}
+
+// ReplayGuard rejects stale, future-dated and replayed messages. Freshness is
+// judged from MulticastMessage.Timestamp against a clock-skew window, replays
+// from a per-peer monotonic sequence number (with a small window for messages
+// that arrive out of order) and, for signed messages, a nonce
+// cache. Without authentication a forged message can still advance a peer's
+// sequence number, so the guard is only a complete defence together with HMAC.
+type ReplayGuard struct {
+	mutex   sync.Mutex
+	maxSkew time.Duration
+	ttl     time.Duration
+	lastSeq map[string]*seqEntry // keyed by stack ID and host IP
+	nonces  map[string]time.Time
+	// nonceOrder lists the cached nonces oldest first
+	nonceOrder []string
+}
+
+// NewReplayGuard creates a replay guard with the given clock-skew window.
+// A zero window disables the timestamp check.
+func NewReplayGuard(maxSkew time.Duration) *ReplayGuard {
+	// A message can only be rejected as a replay while its nonce and
+	// sequence number are remembered, so they are kept for at least as long
+	// as its timestamp passes the skew check
+	ttl := ReplayTTL
+	if 2*maxSkew > ttl {
+		ttl = 2 * maxSkew
+	}
+
+	return &ReplayGuard{
+		maxSkew: maxSkew,
+		ttl:     ttl,
+		lastSeq: make(map[string]*seqEntry),
+		nonces:  make(map[string]time.Time),
+	}
+}
+
+// Check validates the freshness of a message and records it as seen
+func (g *ReplayGuard) Check(message *types.MulticastMessage) error {
+	now := time.Now()
+
+	if g.maxSkew > 0 {
+		sent := time.Unix(message.Timestamp, 0)
+		if now.Sub(sent) > g.maxSkew {
+			return &RejectError{Reason: ReasonStale, Detail: fmt.Sprintf("sent %s ago", now.Sub(sent).Round(time.Second))}
+		}
+		if sent.Sub(now) > g.maxSkew {
+			return &RejectError{Reason: ReasonFuture, Detail: fmt.Sprintf("sent %s in the future", sent.Sub(now).Round(time.Second))}
+		}
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if message.Nonce != "" {
+		if _, seen := g.nonces[message.Nonce]; seen {
+			return &RejectError{Reason: ReasonReplayedNonce, Detail: fmt.Sprintf("nonce %s already seen", message.Nonce)}
+		}
+	}
+
+	// Peers that predate sequence numbers send zero; only the timestamp applies to them
+	if message.Seq != 0 {
+		// Sequences are tracked per stack ID and host IP, so two hosts
+		// mistakenly sharing a stack ID are both admitted and can be
+		// reported as a conflict instead of hiding each other
+		key := message.StackID + "/" + message.HostIP
+		entry, exists := g.lastSeq[key]
+		if !exists {
+			if len(g.lastSeq) >= MaxSeqEntries {
+				g.evictOldestSeqLocked()
+			}
+			entry = &seqEntry{}
+			g.lastSeq[key] = entry
+		}
+		if !entry.accept(message.Seq) {
+			return &RejectError{Reason: ReasonReplayedSeq, Detail: fmt.Sprintf("seq %d already seen or too old (highest %d)", message.Seq, entry.highest)}
+		}
+		entry.lastSeen = now
+	}
+
+	if message.Nonce != "" {
+		if len(g.nonceOrder) >= MaxNonces {
+			delete(g.nonces, g.nonceOrder[0])
+			g.nonceOrder = g.nonceOrder[1:]
+		}
+		g.nonces[message.Nonce] = now
+		g.nonceOrder = append(g.nonceOrder, message.Nonce)
+	}
+
+	return nil
+}
+
+// evictOldestSeqLocked forgets the peer whose sequence number was seen least
+// recently
+func (g *ReplayGuard) evictOldestSeqLocked() {
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range g.lastSeq {
+		if oldestKey == "" || entry.lastSeen.Before(oldest) {
+			oldestKey, oldest = key, entry.lastSeen
+		}
+	}
+	delete(g.lastSeq, oldestKey)
+}
+
+// Expire forgets nonces and sequence numbers not seen within the replay TTL.
+// With the timestamp check enabled, any message carrying them would already
+// be rejected as stale.
+func (g *ReplayGuard) Expire() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	cutoff := time.Now().Add(-g.ttl)
+	expired := 0
+	for _, nonce := range g.nonceOrder {
+		if !g.nonces[nonce].Before(cutoff) {
+			break
+		}
+		delete(g.nonces, nonce)
+		expired++
+	}
+	// Copy the remainder so the backing array does not grow without bound
+	g.nonceOrder = append([]string(nil), g.nonceOrder[expired:]...)
+
+	for key, entry := range g.lastSeq {
+		if entry.lastSeen.Before(cutoff) {
+			delete(g.lastSeq, key)
+		}
+	}
+}
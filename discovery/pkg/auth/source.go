@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/docker-router/discovery/pkg/types"
+)
+
+// SourceMode controls how the UDP source address of an announcement is
+// compared with the HostIP it advertises
+type SourceMode string
+
+const (
+	// SourceModeOff trusts the advertised HostIP
+	SourceModeOff SourceMode = "off"
+	// SourceModeStrict rejects announcements whose source differs from HostIP
+	SourceModeStrict SourceMode = "strict"
+	// SourceModeNAT accepts the announcement and records the observed source
+	// as the peer's reflexive endpoint
+	SourceModeNAT SourceMode = "nat"
+)
+
+// ParseSourceMode parses a source verification mode, defaulting to off
+func ParseSourceMode(value string) (SourceMode, error) {
+	switch SourceMode(value) {
+	case "", SourceModeOff:
+		return SourceModeOff, nil
+	case SourceModeStrict, SourceModeNAT:
+		return SourceMode(value), nil
+	}
+	return "", fmt.Errorf("unknown source verification mode %q (expected off, strict or nat)", value)
+}
+
+// CheckSource verifies the source address of a message according to mode.
+// It returns the reflexive IP to record for the peer, which is only set in
+// NAT mode.
+func CheckSource(mode SourceMode, message *types.MulticastMessage, addr *net.UDPAddr) (string, error) {
+	if mode == SourceModeOff || addr == nil {
+		return "", nil
+	}
+
+	if mode == SourceModeNAT {
+		return addr.IP.String(), nil
+	}
+
+	advertised := net.ParseIP(message.HostIP)
+	if advertised == nil {
+		return "", fmt.Errorf("advertised host IP %q is not a valid address", message.HostIP)
+	}
+	if advertised.Equal(addr.IP) {
+		return "", nil
+	}
+	// A dual-stack peer reaches us over either of its addresses
+	for _, address := range message.Addresses {
+		if ip := net.ParseIP(address); ip != nil && ip.Equal(addr.IP) {
+			return "", nil
+		}
+	}
+	return "", fmt.Errorf("source %s does not match advertised host IP %s", addr.IP, message.HostIP)
+}
@@ -0,0 +1,422 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker-router/discovery/pkg/metrics"
+	"github.com/docker-router/discovery/pkg/storage"
+	"github.com/docker-router/discovery/pkg/types"
+)
+
+const (
+	// DefaultPeerTimeout is how long after its last report a peer that does
+	// not advertise its announce interval is marked stale
+	DefaultPeerTimeout = 90 * time.Second
+	// DefaultStaleHold is how long a stale peer is kept before it is removed
+	DefaultStaleHold = 60 * time.Second
+	// EventBufferSize is the recommended capacity of a backend's event channel
+	EventBufferSize = 64
+	// MaxCleanupInterval bounds the time between cleanup passes, since peers
+	// advertising short announce intervals time out sooner than PeerTimeout
+	MaxCleanupInterval = 10 * time.Second
+	// CounterPeersRejected counts announcements of new peers dropped because
+	// the peer limit was reached
+	CounterPeersRejected = "peers_rejected"
+	// CounterFileWrites counts discovery file writes, and
+	// CounterFileUnchanged the writes skipped because nothing routers act
+	// on changed
+	CounterFileWrites    = "file_writes"
+	CounterFileUnchanged = "file_unchanged"
+	// managerCounterPrefix prefixes the manager's own counters in Stats
+	managerCounterPrefix = "manager."
+)
+
+// EventType identifies what happened to a peer
+type EventType string
+
+const (
+	// EventPeerUp reports a discovered or refreshed peer
+	EventPeerUp EventType = "up"
+	// EventPeerDown reports that a backend no longer sees a peer
+	EventPeerDown EventType = "down"
+	// EventPeerStatus changes the status of a known peer, e.g. from failure detection
+	EventPeerStatus EventType = "status"
+)
+
+// PeerEvent is a change in a backend's view of a peer
+type PeerEvent struct {
+	Type EventType
+	Peer types.Peer
+	// VNIs are the overlays the event applies to. When empty, an up event
+	// applies to Peer.VNI and down and status events to every overlay.
+	VNIs []int
+}
+
+// Backend is a source of peer discovery events
+type Backend interface {
+	// Name identifies the backend; it is recorded as the source of its peers
+	Name() string
+	// Start begins discovery
+	Start() error
+	// Stop ends discovery; no events are sent after it returns
+	Stop() error
+	// Events returns the stream of peer events
+	Events() <-chan PeerEvent
+}
+
+// CounterSource is implemented by backends that keep counters
+type CounterSource interface {
+	Counters() map[string]uint64
+}
+
+// Manager runs several backends and merges their peers into one storage per
+// VNI, so every overlay gets its own peer table and discovery file
+type Manager struct {
+	storages    map[int]*storage.FileStorage
+	vnis        []int
+	backends    []Backend
+	peerTimeout time.Duration
+	// staleHold is how long a peer stays in the stale state after
+	// peerTimeout before it is removed
+	staleHold time.Duration
+	// startupGrace holds back the first discovery file write so it already
+	// contains the peers that answered the startup queries
+	startupGrace time.Duration
+	graceOver    atomic.Bool
+	// maxPeers caps the peers of each VNI; zero means no limit
+	maxPeers int
+	// statsFile is where the counters are written; empty disables it
+	statsFile string
+	counters  *metrics.Counters
+	// limitLogged records the VNIs whose peer limit was already logged, so
+	// a flood of new stack IDs is logged once
+	limitLogged map[int]bool
+	limitMutex  sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewManager creates a backend manager; every served VNI must be added with
+// AddVNI before Start
+func NewManager() *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Manager{
+		storages:    make(map[int]*storage.FileStorage),
+		peerTimeout: DefaultPeerTimeout,
+		staleHold:   DefaultStaleHold,
+		counters:    metrics.NewCounters(),
+		limitLogged: make(map[int]bool),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// AddVNI serves a VNI, keeping its peers in the given storage. Peers of VNIs
+// that were not added are dropped.
+func (m *Manager) AddVNI(vni int, storage *storage.FileStorage) {
+	if _, exists := m.storages[vni]; !exists {
+		m.vnis = append(m.vnis, vni)
+	}
+	m.storages[vni] = storage
+}
+
+// Add registers a backend; backends must be added before Start
+func (m *Manager) Add(backend Backend) {
+	m.backends = append(m.backends, backend)
+}
+
+// Backends returns the registered backends
+func (m *Manager) Backends() []Backend {
+	return m.backends
+}
+
+// SetPeerTimeout sets how long after its last report a peer is marked stale
+// when it does not advertise its announce interval
+func (m *Manager) SetPeerTimeout(timeout time.Duration) {
+	m.peerTimeout = timeout
+}
+
+// SetStaleHold sets how long a timed-out peer is kept as stale before it is
+// removed
+func (m *Manager) SetStaleHold(hold time.Duration) {
+	m.staleHold = hold
+}
+
+// SetStartupGrace sets how long after Start the first discovery file write
+// is held back
+func (m *Manager) SetStartupGrace(grace time.Duration) {
+	m.startupGrace = grace
+}
+
+// SetMaxPeers caps the number of peers kept per VNI; announcements of further
+// new peers are dropped and counted. Zero means no limit.
+func (m *Manager) SetMaxPeers(max int) {
+	m.maxPeers = max
+}
+
+// SetStatsFile makes the manager write the counters of every backend to the
+// given file while running
+func (m *Manager) SetStatsFile(path string) {
+	m.statsFile = path
+}
+
+// Stats returns the counters of the manager and of every backend, named
+// "<backend>.<counter>"
+func (m *Manager) Stats() map[string]uint64 {
+	stats := make(map[string]uint64)
+	for name, value := range m.counters.Snapshot() {
+		stats[managerCounterPrefix+name] = value
+	}
+	for _, b := range m.backends {
+		if counters, ok := b.(CounterSource); ok {
+			for name, value := range counters.Counters() {
+				stats[b.Name()+"."+name] = value
+			}
+		}
+	}
+	return stats
+}
+
+// Start starts every backend and begins merging their events
+func (m *Manager) Start() error {
+	if len(m.backends) == 0 {
+		return fmt.Errorf("no discovery backends configured")
+	}
+	if len(m.storages) == 0 {
+		return fmt.Errorf("no VNIs configured")
+	}
+	// A stack ID flapping between host IPs within a peer timeout is a duplicate
+	for _, storage := range m.storages {
+		storage.SetConflictWindow(m.peerTimeout)
+		storage.SetMaxPeers(m.maxPeers)
+	}
+
+	for i, backend := range m.backends {
+		if err := backend.Start(); err != nil {
+			// Stop the backends that already started
+			for _, started := range m.backends[:i] {
+				started.Stop()
+			}
+			return fmt.Errorf("failed to start %s backend: %w", backend.Name(), err)
+		}
+
+		m.wg.Add(1)
+		go m.consumeLoop(backend)
+	}
+
+	m.wg.Add(2)
+	go m.cleanupLoop()
+	go m.endGrace()
+
+	return nil
+}
+
+// Stop stops every backend and the merge loops
+func (m *Manager) Stop() error {
+	var firstErr error
+	for _, backend := range m.backends {
+		if err := backend.Stop(); err != nil {
+			log.Printf("Error stopping %s backend: %v", backend.Name(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	m.cancel()
+	m.wg.Wait()
+	return firstErr
+}
+
+// consumeLoop applies one backend's events to the storage
+func (m *Manager) consumeLoop(backend Backend) {
+	defer m.wg.Done()
+
+	events := backend.Events()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			m.handleEvent(backend.Name(), event)
+		}
+	}
+}
+
+// handleEvent records a peer event in the storage of every VNI it applies to
+// and rewrites their discovery files
+func (m *Manager) handleEvent(source string, event PeerEvent) {
+	vnis := event.VNIs
+	if len(vnis) == 0 && event.Type == EventPeerUp {
+		vnis = []int{event.Peer.VNI}
+	}
+	if len(vnis) == 0 {
+		vnis = m.vnis
+	}
+
+	for _, vni := range vnis {
+		storage, exists := m.storages[vni]
+		if !exists {
+			if event.Type == EventPeerUp {
+				log.Printf("Ignoring peer %s from %s in foreign VNI %d", event.Peer.StackID, source, vni)
+			}
+			continue
+		}
+
+		switch event.Type {
+		case EventPeerUp:
+			peer := event.Peer
+			peer.VNI = vni
+			if !storage.AddPeer(&peer, source) {
+				m.rejectPeer(vni, peer.StackID, source)
+				continue
+			}
+		case EventPeerDown:
+			if storage.RemovePeer(event.Peer.StackID, source) {
+				log.Printf("Peer %s withdrawn from VNI %d by %s", event.Peer.StackID, vni, source)
+			}
+		case EventPeerStatus:
+			if !storage.SetPeerStatus(event.Peer.StackID, event.Peer.Status) {
+				continue
+			}
+			log.Printf("Peer %s is now %s in VNI %d (reported by %s)", event.Peer.StackID, event.Peer.Status, vni, source)
+		default:
+			log.Printf("Ignoring unknown %s event %q for peer %s", source, event.Type, event.Peer.StackID)
+			return
+		}
+
+		m.writeDiscoveryFile(vni)
+	}
+}
+
+// rejectPeer counts a new peer dropped because its VNI is full, logging only
+// the first one until the VNI has room again
+func (m *Manager) rejectPeer(vni int, stackID, source string) {
+	m.counters.Inc(CounterPeersRejected)
+
+	m.limitMutex.Lock()
+	defer m.limitMutex.Unlock()
+	if !m.limitLogged[vni] {
+		m.limitLogged[vni] = true
+		log.Printf("Warning: peer limit of %d reached in VNI %d, dropping new peer %s from %s and any further ones", m.maxPeers, vni, stackID, source)
+	}
+}
+
+// endGrace writes the first discovery files once the startup grace period ends
+func (m *Manager) endGrace() {
+	defer m.wg.Done()
+
+	select {
+	case <-m.ctx.Done():
+		return
+	case <-time.After(m.startupGrace):
+	}
+
+	m.graceOver.Store(true)
+	for _, vni := range m.vnis {
+		log.Printf("Startup grace period over with %d peers in VNI %d", m.storages[vni].GetPeerCount(), vni)
+		m.writeDiscoveryFile(vni)
+	}
+}
+
+// writeDiscoveryFile writes the discovery file of a VNI unless still in the
+// startup grace period; the storage skips writes that change nothing
+func (m *Manager) writeDiscoveryFile(vni int) {
+	if !m.graceOver.Load() {
+		return
+	}
+	written, err := m.storages[vni].WriteDiscoveryFile()
+	if err != nil {
+		log.Printf("Error writing discovery file for VNI %d: %v", vni, err)
+		return
+	}
+	if written {
+		m.counters.Inc(CounterFileWrites)
+	} else {
+		m.counters.Inc(CounterFileUnchanged)
+	}
+}
+
+// cleanupLoop periodically cleans up stale peers and writes the stats file
+func (m *Manager) cleanupLoop() {
+	defer m.wg.Done()
+
+	interval := m.peerTimeout / 3
+	if interval > MaxCleanupInterval {
+		interval = MaxCleanupInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			for _, vni := range m.vnis {
+				m.storages[vni].CleanupStale(m.peerTimeout, m.staleHold)
+				m.writeDiscoveryFile(vni)
+			}
+			m.resetPeerLimits()
+			m.writeStatsFile()
+		}
+	}
+}
+
+// resetPeerLimits re-arms the peer limit warning of VNIs that have room again
+func (m *Manager) resetPeerLimits() {
+	m.limitMutex.Lock()
+	defer m.limitMutex.Unlock()
+	for vni := range m.limitLogged {
+		if m.storages[vni].GetPeerCount() < m.maxPeers {
+			delete(m.limitLogged, vni)
+		}
+	}
+}
+
+// writeStatsFile writes the current counters to the stats file
+func (m *Manager) writeStatsFile() {
+	if m.statsFile == "" {
+		return
+	}
+	if err := storage.WriteStatsFile(m.statsFile, m.Stats()); err != nil {
+		log.Printf("Error writing stats file: %v", err)
+	}
+}
+
+// Emit sends an event on a backend's channel unless ctx is done first
+func Emit(ctx context.Context, events chan<- PeerEvent, event PeerEvent) {
+	select {
+	case events <- event:
+	case <-ctx.Done():
+	}
+}
+
+// EmitSnapshot reports a backend's complete current peer list: every listed
+// peer is sent as up, and peers in previous that are no longer listed are sent
+// as down. It returns the set of stack IDs to pass as previous next time.
+func EmitSnapshot(ctx context.Context, events chan<- PeerEvent, previous map[string]bool, peers []types.Peer) map[string]bool {
+	current := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		current[peer.StackID] = true
+		Emit(ctx, events, PeerEvent{Type: EventPeerUp, Peer: peer})
+	}
+
+	for stackID := range previous {
+		if !current[stackID] {
+			Emit(ctx, events, PeerEvent{Type: EventPeerDown, Peer: types.Peer{StackID: stackID}})
+		}
+	}
+	return current
+}
@@ -0,0 +1,179 @@
+package dnssrv
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker-router/discovery/pkg/backend"
+	"github.com/docker-router/discovery/pkg/netutil"
+	"github.com/docker-router/discovery/pkg/protocol"
+	"github.com/docker-router/discovery/pkg/types"
+)
+
+const (
+	DefaultRefreshInterval = 30 * time.Second
+	// ServicePrefix is prepended to DNS_DOMAIN to form the SRV record name
+	ServicePrefix = "_docker-router._udp."
+	// StackIDKey prefixes the TXT record value giving a target's stack ID
+	StackIDKey = "stack_id="
+	// SourceName is recorded as the source of peers found in DNS
+	SourceName = "dns"
+)
+
+// Backend reports peers published as DNS SRV records and implements
+// backend.Backend. Each SRV target is one peer with its first address as host
+// IP. Its stack ID comes from a "stack_id=<id>" TXT record on the target name,
+// so a stack also found by another backend is listed once; without one, the
+// target name (without the trailing dot) is used.
+type Backend struct {
+	name            string
+	vni             int
+	refreshInterval time.Duration
+	resolver        *net.Resolver
+	events          chan backend.PeerEvent
+	known           map[string]bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewBackend creates a DNS SRV backend for the given record name
+func NewBackend(name string, vni int) *Backend {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Backend{
+		name:            name,
+		vni:             vni,
+		refreshInterval: DefaultRefreshInterval,
+		resolver:        net.DefaultResolver,
+		events:          make(chan backend.PeerEvent, backend.EventBufferSize),
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+}
+
+// RecordName returns the SRV record name for a DNS domain
+func RecordName(domain string) string {
+	return ServicePrefix + strings.TrimSuffix(domain, ".") + "."
+}
+
+// SetRefreshInterval sets how often the SRV record is resolved
+func (b *Backend) SetRefreshInterval(interval time.Duration) {
+	b.refreshInterval = interval
+}
+
+// Name returns the backend name
+func (b *Backend) Name() string {
+	return SourceName
+}
+
+// Events returns the stream of peers found in DNS
+func (b *Backend) Events() <-chan backend.PeerEvent {
+	return b.events
+}
+
+// Start begins resolving the SRV record
+func (b *Backend) Start() error {
+	if b.name == "" {
+		return fmt.Errorf("DNS discovery requires an SRV record name")
+	}
+
+	log.Printf("DNS discovery started for %s", b.name)
+
+	b.wg.Add(1)
+	go b.refreshLoop()
+	return nil
+}
+
+// Stop stops the backend
+func (b *Backend) Stop() error {
+	b.cancel()
+	b.wg.Wait()
+	log.Printf("DNS discovery stopped")
+	return nil
+}
+
+// refreshLoop periodically resolves the SRV record
+func (b *Backend) refreshLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		b.refresh()
+
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh resolves the SRV record and reports its targets
+func (b *Backend) refresh() {
+	peers, err := b.lookup()
+	if err != nil {
+		// Keep reporting the last known peers while DNS is unavailable
+		log.Printf("Error resolving %s: %v", b.name, err)
+		return
+	}
+
+	b.known = backend.EmitSnapshot(b.ctx, b.events, b.known, peers)
+}
+
+// lookup resolves the SRV record into peers, skipping this host
+func (b *Backend) lookup() ([]types.Peer, error) {
+	ctx, cancel := context.WithTimeout(b.ctx, 10*time.Second)
+	defer cancel()
+
+	_, records, err := b.resolver.LookupSRV(ctx, "", "", b.name)
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []types.Peer
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+
+		addrs, err := b.resolver.LookupIPAddr(ctx, target)
+		if err != nil || len(addrs) == 0 {
+			log.Printf("Error resolving SRV target %s: %v", target, err)
+			continue
+		}
+		ip := addrs[0].IP
+		if netutil.IsLocalIP(ip) {
+			continue
+		}
+
+		peers = append(peers, types.Peer{
+			StackID:       b.stackID(ctx, target),
+			HostIP:        ip.String(),
+			VXLANEndpoint: net.JoinHostPort(ip.String(), fmt.Sprint(protocol.VXLANPort)),
+			VNI:           b.vni,
+		})
+	}
+	return peers, nil
+}
+
+// stackID returns the stack ID published in a TXT record on target, or the
+// target name when there is none
+func (b *Backend) stackID(ctx context.Context, target string) string {
+	records, err := b.resolver.LookupTXT(ctx, target)
+	if err != nil {
+		return target
+	}
+	for _, record := range records {
+		if stackID, found := strings.CutPrefix(record, StackIDKey); found && stackID != "" {
+			return stackID
+		}
+	}
+	return target
+}
@@ -0,0 +1,555 @@
+package gossip
+
+import (
+	"context"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/docker-router/discovery/pkg/types"
+)
+
+// Member states
+const (
+	StateAlive   = "alive"
+	StateSuspect = "suspect"
+	StateDead    = "dead"
+)
+
+const (
+	DefaultProbeInterval  = 1 * time.Second
+	DefaultProbeTimeout   = 300 * time.Millisecond
+	DefaultIndirectProbes = 3
+	DefaultSuspectTimeout = 5 * time.Second
+	DefaultRetransmitMult = 3
+	DefaultMaxUpdates     = 8
+	// DefaultDeadRetention is how long dead members are remembered, so their
+	// death keeps being gossiped and late alive updates can be ordered
+	DefaultDeadRetention = 60 * time.Second
+)
+
+// Config holds the gossip protocol parameters
+type Config struct {
+	// ProbeInterval is the protocol period: one member is probed per period
+	ProbeInterval time.Duration
+	// ProbeTimeout is how long to wait for a direct ack before probing indirectly
+	ProbeTimeout time.Duration
+	// IndirectProbes is the number of members asked to probe on our behalf
+	IndirectProbes int
+	// SuspectTimeout is how long a member stays suspect before it is declared dead
+	SuspectTimeout time.Duration
+	// RetransmitMult scales how many times each update is piggybacked (mult * log(n))
+	RetransmitMult int
+	// MaxUpdates caps the number of updates piggybacked on one message
+	MaxUpdates int
+}
+
+// DefaultConfig returns the default gossip parameters
+func DefaultConfig() Config {
+	return Config{
+		ProbeInterval:  DefaultProbeInterval,
+		ProbeTimeout:   DefaultProbeTimeout,
+		IndirectProbes: DefaultIndirectProbes,
+		SuspectTimeout: DefaultSuspectTimeout,
+		RetransmitMult: DefaultRetransmitMult,
+		MaxUpdates:     DefaultMaxUpdates,
+	}
+}
+
+// PeerStatus maps a member state to the peer status written to the discovery file
+func PeerStatus(state string) string {
+	switch state {
+	case StateSuspect:
+		return types.PeerStatusSuspect
+	case StateDead:
+		return types.PeerStatusDead
+	}
+	return types.PeerStatusActive
+}
+
+// Transport builds and sends protocol messages on behalf of the membership
+type Transport interface {
+	NewMessage(messageType string) *types.MulticastMessage
+	SendMessage(message *types.MulticastMessage, addr *net.UDPAddr) error
+}
+
+// StateChangeFunc is called when a member changes state
+type StateChangeFunc func(stackID, state string)
+
+// member is the local view of a remote peer
+type member struct {
+	stackID     string
+	addr        *net.UDPAddr
+	state       string
+	incarnation uint64
+	stateSince  time.Time
+}
+
+// pendingUpdate is a membership delta waiting to be piggybacked
+type pendingUpdate struct {
+	update    types.MemberUpdate
+	transmits int
+}
+
+// relay is an indirect probe we are performing for another member
+type relay struct {
+	requester *net.UDPAddr
+	probeID   uint64
+	expires   time.Time
+}
+
+// stateChange is a member state change to report once the lock is released
+type stateChange struct {
+	stackID string
+	state   string
+}
+
+// Membership implements SWIM-style failure detection: members are probed
+// directly and, when that fails, indirectly through other members; members
+// that cannot be reached become suspect and are declared dead unless they
+// refute the suspicion with a higher incarnation number. State changes are
+// disseminated by piggybacking them on probe traffic.
+type Membership struct {
+	self      string
+	config    Config
+	transport Transport
+	onChange  StateChangeFunc
+
+	mutex       sync.Mutex
+	incarnation uint64
+	members     map[string]*member
+	probeOrder  []string
+	probeIndex  int
+	updates     map[string]*pendingUpdate
+	pending     map[uint64]chan struct{}
+	relays      map[uint64]*relay
+	nextProbeID uint64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewMembership creates a membership for the local stack
+func NewMembership(self string, config Config, transport Transport, onChange StateChangeFunc) *Membership {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Membership{
+		self:      self,
+		config:    config,
+		transport: transport,
+		onChange:  onChange,
+		// Seeding from the clock lets a restarted member override its old state
+		incarnation: uint64(time.Now().Unix()),
+		members:     make(map[string]*member),
+		updates:     make(map[string]*pendingUpdate),
+		pending:     make(map[uint64]chan struct{}),
+		relays:      make(map[uint64]*relay),
+		nextProbeID: rand.Uint64(),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Start begins probing members
+func (m *Membership) Start() {
+	log.Printf("Gossip membership started (probe interval %s, suspect timeout %s)",
+		m.config.ProbeInterval, m.config.SuspectTimeout)
+
+	m.wg.Add(1)
+	go m.probeLoop()
+}
+
+// Stop stops probing members
+func (m *Membership) Stop() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+// Incarnation returns the local incarnation number
+func (m *Membership) Incarnation() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.incarnation
+}
+
+// Alive records a member heard from directly, e.g. through an announcement.
+// Direct contact is proof of life and clears any suspicion.
+func (m *Membership) Alive(stackID string, addr *net.UDPAddr, incarnation uint64) {
+	var changes []stateChange
+
+	m.mutex.Lock()
+	mem, exists := m.members[stackID]
+	if !exists {
+		m.members[stackID] = &member{
+			stackID:     stackID,
+			addr:        addr,
+			state:       StateAlive,
+			incarnation: incarnation,
+			stateSince:  time.Now(),
+		}
+		m.mutex.Unlock()
+		return
+	}
+
+	mem.addr = addr
+	if incarnation > mem.incarnation {
+		mem.incarnation = incarnation
+	}
+	if mem.state != StateAlive {
+		changes = append(changes, m.setStateLocked(mem, StateAlive, mem.incarnation))
+	}
+	m.mutex.Unlock()
+
+	m.notify(changes)
+}
+
+// Leave forgets a member that announced it is shutting down
+func (m *Membership) Leave(stackID string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.members, stackID)
+	delete(m.updates, stackID)
+}
+
+// HandleMessage processes a gossip protocol message
+func (m *Membership) HandleMessage(message *types.MulticastMessage, addr *net.UDPAddr) {
+	m.applyUpdates(message.Updates)
+
+	switch message.Type {
+	case types.MessageTypePing:
+		if message.Target != m.self {
+			return
+		}
+		ack := m.newMessage(types.MessageTypeAck)
+		ack.ProbeID = message.ProbeID
+		ack.Target = m.self
+		m.send(ack, addr)
+
+	case types.MessageTypePingReq:
+		target, err := net.ResolveUDPAddr("udp", message.TargetAddr)
+		if err != nil {
+			log.Printf("Ignoring gossip ping request for %s: %v", message.TargetAddr, err)
+			return
+		}
+		m.mutex.Lock()
+		relayID := m.newProbeIDLocked()
+		m.relays[relayID] = &relay{
+			requester: addr,
+			probeID:   message.ProbeID,
+			expires:   time.Now().Add(m.config.ProbeInterval),
+		}
+		m.mutex.Unlock()
+
+		ping := m.newMessage(types.MessageTypePing)
+		ping.ProbeID = relayID
+		ping.Target = message.Target
+		m.send(ping, target)
+
+	case types.MessageTypeAck:
+		m.mutex.Lock()
+		if ackCh, exists := m.pending[message.ProbeID]; exists {
+			delete(m.pending, message.ProbeID)
+			close(ackCh)
+			m.mutex.Unlock()
+			return
+		}
+		r, exists := m.relays[message.ProbeID]
+		delete(m.relays, message.ProbeID)
+		m.mutex.Unlock()
+
+		if exists {
+			ack := m.newMessage(types.MessageTypeAck)
+			ack.ProbeID = r.probeID
+			ack.Target = message.Target
+			m.send(ack, r.requester)
+		}
+	}
+}
+
+// probeLoop probes one member per protocol period
+func (m *Membership) probeLoop() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.config.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			m.probe()
+			m.expire()
+		}
+	}
+}
+
+// probe runs one round of direct and, if needed, indirect probing
+func (m *Membership) probe() {
+	m.mutex.Lock()
+	target := m.nextTargetLocked()
+	if target == nil {
+		m.mutex.Unlock()
+		return
+	}
+	targetID, targetAddr, incarnation := target.stackID, target.addr, target.incarnation
+	wasAlive := target.state == StateAlive
+	probeID := m.newProbeIDLocked()
+	ackCh := make(chan struct{})
+	m.pending[probeID] = ackCh
+	m.mutex.Unlock()
+
+	defer func() {
+		m.mutex.Lock()
+		delete(m.pending, probeID)
+		m.mutex.Unlock()
+	}()
+
+	ping := m.newMessage(types.MessageTypePing)
+	ping.ProbeID = probeID
+	ping.Target = targetID
+	m.send(ping, targetAddr)
+
+	if m.waitAck(ackCh, m.config.ProbeTimeout) {
+		return
+	}
+
+	// Ask other members to probe the target for us
+	for _, helper := range m.randomMembers(m.config.IndirectProbes, targetID) {
+		request := m.newMessage(types.MessageTypePingReq)
+		request.ProbeID = probeID
+		request.Target = targetID
+		request.TargetAddr = targetAddr.String()
+		m.send(request, helper)
+	}
+
+	if m.waitAck(ackCh, m.config.ProbeInterval-m.config.ProbeTimeout) {
+		return
+	}
+
+	if wasAlive {
+		log.Printf("Gossip probe of %s failed, marking suspect", targetID)
+	}
+	m.applyUpdates([]types.MemberUpdate{{StackID: targetID, State: StateSuspect, Incarnation: incarnation}})
+}
+
+// waitAck waits for a probe to be acknowledged
+func (m *Membership) waitAck(ackCh chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ackCh:
+		return true
+	case <-timer.C:
+		return false
+	case <-m.ctx.Done():
+		return false
+	}
+}
+
+// expire declares timed-out suspects dead and forgets old dead members and relays
+func (m *Membership) expire() {
+	var changes []stateChange
+	now := time.Now()
+
+	m.mutex.Lock()
+	for stackID, mem := range m.members {
+		switch {
+		case mem.state == StateSuspect && now.Sub(mem.stateSince) > m.config.SuspectTimeout:
+			log.Printf("Gossip member %s did not refute suspicion, marking dead", stackID)
+			changes = append(changes, m.setStateLocked(mem, StateDead, mem.incarnation))
+		case mem.state == StateDead && now.Sub(mem.stateSince) > DefaultDeadRetention:
+			delete(m.members, stackID)
+		}
+	}
+	for id, r := range m.relays {
+		if now.After(r.expires) {
+			delete(m.relays, id)
+		}
+	}
+	m.mutex.Unlock()
+
+	m.notify(changes)
+}
+
+// applyUpdates merges membership deltas using SWIM's incarnation ordering
+func (m *Membership) applyUpdates(updates []types.MemberUpdate) {
+	var changes []stateChange
+
+	m.mutex.Lock()
+	for _, update := range updates {
+		if update.StackID == m.self {
+			// Refute suspicion or death by advertising a newer incarnation
+			if update.State != StateAlive && update.Incarnation >= m.incarnation {
+				m.incarnation = update.Incarnation + 1
+				log.Printf("Refuting gossip %s state with incarnation %d", update.State, m.incarnation)
+				m.queueUpdateLocked(types.MemberUpdate{StackID: m.self, State: StateAlive, Incarnation: m.incarnation})
+			}
+			continue
+		}
+
+		// Members are only introduced by discovery announcements
+		mem, exists := m.members[update.StackID]
+		if !exists {
+			continue
+		}
+
+		apply := false
+		switch update.State {
+		case StateAlive:
+			apply = update.Incarnation > mem.incarnation
+		case StateSuspect:
+			apply = (mem.state == StateAlive && update.Incarnation >= mem.incarnation) ||
+				(mem.state == StateSuspect && update.Incarnation > mem.incarnation)
+		case StateDead:
+			apply = mem.state != StateDead && update.Incarnation >= mem.incarnation
+		}
+		if apply {
+			changes = append(changes, m.setStateLocked(mem, update.State, update.Incarnation))
+		}
+	}
+	m.mutex.Unlock()
+
+	m.notify(changes)
+}
+
+// setStateLocked changes a member's state and queues the change for gossip
+func (m *Membership) setStateLocked(mem *member, state string, incarnation uint64) stateChange {
+	if mem.state != state {
+		mem.stateSince = time.Now()
+	}
+	mem.state = state
+	mem.incarnation = incarnation
+	m.queueUpdateLocked(types.MemberUpdate{StackID: mem.stackID, State: state, Incarnation: incarnation})
+	return stateChange{stackID: mem.stackID, state: state}
+}
+
+// queueUpdateLocked queues a delta, replacing any older one for the same member
+func (m *Membership) queueUpdateLocked(update types.MemberUpdate) {
+	m.updates[update.StackID] = &pendingUpdate{update: update}
+}
+
+// notify reports state changes to the callback
+func (m *Membership) notify(changes []stateChange) {
+	if m.onChange == nil {
+		return
+	}
+	for _, change := range changes {
+		m.onChange(change.stackID, change.state)
+	}
+}
+
+// newMessage builds a protocol message with piggybacked updates
+func (m *Membership) newMessage(messageType string) *types.MulticastMessage {
+	message := m.transport.NewMessage(messageType)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	message.Incarnation = m.incarnation
+	message.Updates = m.piggybackLocked()
+	return message
+}
+
+// piggybackLocked selects the least transmitted updates and retires those
+// that have been sent often enough to have reached every member
+func (m *Membership) piggybackLocked() []types.MemberUpdate {
+	limit := m.config.RetransmitMult * int(math.Ceil(math.Log2(float64(len(m.members)+2))))
+
+	var selected []types.MemberUpdate
+	for len(selected) < m.config.MaxUpdates {
+		var best *pendingUpdate
+		for _, pending := range m.updates {
+			if pending.transmits < limit && (best == nil || pending.transmits < best.transmits) {
+				if !containsUpdate(selected, pending.update.StackID) {
+					best = pending
+				}
+			}
+		}
+		if best == nil {
+			break
+		}
+		best.transmits++
+		selected = append(selected, best.update)
+	}
+
+	for stackID, pending := range m.updates {
+		if pending.transmits >= limit {
+			delete(m.updates, stackID)
+		}
+	}
+	return selected
+}
+
+// containsUpdate reports whether an update for stackID is already selected
+func containsUpdate(updates []types.MemberUpdate, stackID string) bool {
+	for _, update := range updates {
+		if update.StackID == stackID {
+			return true
+		}
+	}
+	return false
+}
+
+// nextTargetLocked returns the next member to probe in a shuffled round-robin order
+func (m *Membership) nextTargetLocked() *member {
+	for attempts := 0; attempts < 2; attempts++ {
+		for m.probeIndex < len(m.probeOrder) {
+			mem, exists := m.members[m.probeOrder[m.probeIndex]]
+			m.probeIndex++
+			if exists && mem.state != StateDead && mem.addr != nil {
+				return mem
+			}
+		}
+
+		// Start a new round in a fresh random order
+		m.probeOrder = m.probeOrder[:0]
+		for stackID := range m.members {
+			m.probeOrder = append(m.probeOrder, stackID)
+		}
+		rand.Shuffle(len(m.probeOrder), func(i, j int) {
+			m.probeOrder[i], m.probeOrder[j] = m.probeOrder[j], m.probeOrder[i]
+		})
+		m.probeIndex = 0
+	}
+	return nil
+}
+
+// randomMembers picks up to n alive members other than exclude
+func (m *Membership) randomMembers(n int, exclude string) []*net.UDPAddr {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var candidates []*net.UDPAddr
+	for stackID, mem := range m.members {
+		if stackID != exclude && mem.state == StateAlive && mem.addr != nil {
+			candidates = append(candidates, mem.addr)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+// newProbeIDLocked returns a probe ID unique to this member
+func (m *Membership) newProbeIDLocked() uint64 {
+	m.nextProbeID++
+	return m.nextProbeID
+}
+
+// send sends a protocol message, logging failures
+func (m *Membership) send(message *types.MulticastMessage, addr *net.UDPAddr) {
+	if err := m.transport.SendMessage(message, addr); err != nil {
+		log.Printf("Error sending gossip %s to %s: %v", message.Type, addr, err)
+	}
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+)
+
+// Counters is a set of named, monotonically increasing counters
+type Counters struct {
+	mutex  sync.RWMutex
+	values map[string]uint64
+}
+
+// NewCounters creates an empty counter set
+func NewCounters() *Counters {
+	return &Counters{
+		values: make(map[string]uint64),
+	}
+}
+
+// Inc increments the named counter by one
+func (c *Counters) Inc(name string) {
+	c.Add(name, 1)
+}
+
+// Add increments the named counter by delta
+func (c *Counters) Add(name string, delta uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[name] += delta
+}
+
+// Get returns the current value of the named counter
+func (c *Counters) Get(name string) uint64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.values[name]
+}
+
+// Snapshot returns a copy of all counters
+func (c *Counters) Snapshot() map[string]uint64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	snapshot := make(map[string]uint64, len(c.values))
+	for name, value := range c.values {
+		snapshot[name] = value
+	}
+	return snapshot
+}
+
+// Names returns the counter names in sorted order
+func (c *Counters) Names() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	names := make([]string, 0, len(c.values))
+	for name := range c.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
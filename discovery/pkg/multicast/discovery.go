@@ -2,183 +2,374 @@ package multicast
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"os"
 	"sync"
 	"time"
 
-	"github.com/docker-router/discovery/pkg/storage"
+	"github.com/docker-router/discovery/pkg/backend"
+	"github.com/docker-router/discovery/pkg/gossip"
+	"github.com/docker-router/discovery/pkg/netutil"
+	"github.com/docker-router/discovery/pkg/protocol"
 	"github.com/docker-router/discovery/pkg/types"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"golang.org/x/sys/unix"
 )
 
 const (
-	DefaultMulticastGroup = "239.1.1.1"
-	DefaultPort          = 4790
-	DefaultAnnounceInterval = 30 * time.Second
-	DefaultPeerTimeout   = 90 * time.Second
-	MaxMessageSize       = 1024
+	DefaultMulticastGroup   = "239.1.1.1"
+	DefaultPort             = protocol.DefaultDiscoveryPort
+	DefaultAnnounceInterval = protocol.DefaultAnnounceInterval
+	// MaxMessageSize is the largest datagram sent; larger messages are
+	// fragmented
+	MaxMessageSize = 1024
+	// DefaultMulticastGroup6 is the site-local group used for IPv6 discovery
+	DefaultMulticastGroup6 = "ff05::4790"
+	// DefaultStartupGrace is the window over which startup queries are spread
+	DefaultStartupGrace = 1500 * time.Millisecond
+	// StartupQueries is the number of queries sent while starting up
+	StartupQueries = 3
+	// MaxResponseDelay bounds the random delay before answering a query, so
+	// a query does not trigger a burst of simultaneous responses
+	MaxResponseDelay = 100 * time.Millisecond
+	// GroupResponseInterval is the minimum interval between responses sent
+	// to the group for queriers that advertise no reply port
+	GroupResponseInterval = 1 * time.Second
+	// SourceName is recorded as the source of peers found by multicast
+	SourceName = "multicast"
 )
 
-// Discovery handles multicast peer discovery
+// Discovery handles multicast peer discovery and implements backend.Backend.
+// Message security settings (authentication, replay protection, source
+// checks) come from the embedded protocol session.
 type Discovery struct {
-	stackID         string
-	hostIP          string
-	vni             int
-	multicastGroup  string
-	port            int
+	*protocol.Session
+
+	multicastGroup   string
+	multicastGroup6  string
+	port             int
 	announceInterval time.Duration
-	peerTimeout     time.Duration
-	storage         *storage.FileStorage
-	
-	conn     *net.UDPConn
-	packetConn *ipv4.PacketConn
-	group    *net.UDPAddr
-	
+	startupGrace     time.Duration
+	events           chan backend.PeerEvent
+	gossipConfig     *gossip.Config
+	interfaceFilter  *netutil.InterfaceFilter
+	membership       *gossip.Membership
+
+	// groups holds one multicast socket per address family in use
+	groups []*groupConn
+
+	groupResponseMutex sync.Mutex
+	lastGroupResponse  time.Time
+
 	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
 }
 
+// newSession creates a protocol session that fragments messages above
+// MaxMessageSize
+func newSession(stackID string, vni int) *protocol.Session {
+	session := protocol.NewSession(stackID, vni)
+	session.SetMaxMessageSize(MaxMessageSize)
+	return session
+}
+
 // NewDiscovery creates a new multicast discovery instance
-func NewDiscovery(stackID string, vni int, storage *storage.FileStorage) *Discovery {
+func NewDiscovery(stackID string, vni int) *Discovery {
 	ctx, cancel := context.WithCancel(context.Background())
-	
+
 	return &Discovery{
-		stackID:         stackID,
-		vni:             vni,
-		multicastGroup:  DefaultMulticastGroup,
-		port:            DefaultPort,
+		Session:          newSession(stackID, vni),
+		multicastGroup:   DefaultMulticastGroup,
+		multicastGroup6:  DefaultMulticastGroup6,
+		port:             DefaultPort,
 		announceInterval: DefaultAnnounceInterval,
-		peerTimeout:     DefaultPeerTimeout,
-		storage:         storage,
-		ctx:             ctx,
-		cancel:          cancel,
+		startupGrace:     DefaultStartupGrace,
+		events:           make(chan backend.PeerEvent, backend.EventBufferSize),
+		ctx:              ctx,
+		cancel:           cancel,
 	}
 }
 
-// SetMulticastGroup sets the multicast group address
+// groupConn is the multicast socket and group of one address family
+type groupConn struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+	// reply is a unicast socket on a port of our own. The multicast socket
+	// shares its port with every stack on the host, so unicast sent to it
+	// may be delivered to a sibling; peers reply to this socket instead.
+	reply     *net.UDPConn
+	replyPort int
+	// interfaces are the interfaces the group was joined on; group messages
+	// are sent out of each of them
+	interfaces []net.Interface
+	// writeTo sends a packet out of the interface with the given index
+	writeTo func(data []byte, ifIndex int, dst net.Addr) error
+}
+
+// SetMulticastGroup sets the IPv4 multicast group address
 func (d *Discovery) SetMulticastGroup(group string) {
 	d.multicastGroup = group
 }
 
+// SetMulticastGroup6 sets the IPv6 multicast group address
+func (d *Discovery) SetMulticastGroup6(group string) {
+	d.multicastGroup6 = group
+}
+
 // SetPort sets the discovery port
 func (d *Discovery) SetPort(port int) {
 	d.port = port
 }
 
-// SetAnnounceInterval sets the announce interval
+// SetAnnounceInterval sets the steady-state announce interval
 func (d *Discovery) SetAnnounceInterval(interval time.Duration) {
 	d.announceInterval = interval
+	d.Session.SetAnnounceInterval(interval)
 }
 
-// SetPeerTimeout sets the peer timeout
-func (d *Discovery) SetPeerTimeout(timeout time.Duration) {
-	d.peerTimeout = timeout
+// SetStartupGrace sets the window over which startup queries are spread
+func (d *Discovery) SetStartupGrace(grace time.Duration) {
+	d.startupGrace = grace
+}
+
+// SetInterfaceFilter restricts the interfaces the multicast group is joined
+// on and announcements are sent from; by default every interface that is up
+// and supports multicast is used
+func (d *Discovery) SetInterfaceFilter(filter *netutil.InterfaceFilter) {
+	d.interfaceFilter = filter
+}
+
+// EnableGossip runs SWIM-style gossip failure detection alongside multicast
+// announcements. Peers found by announcements are probed over unicast, and
+// their status moves through active, suspect and dead as probes fail.
+// Probes are sent to the reply port a peer advertises; peers that advertise
+// none are not probed.
+func (d *Discovery) EnableGossip(config gossip.Config) {
+	d.gossipConfig = &config
+}
+
+// Name returns the backend name
+func (d *Discovery) Name() string {
+	return SourceName
+}
+
+// Events returns the stream of peers discovered over multicast
+func (d *Discovery) Events() <-chan backend.PeerEvent {
+	return d.events
 }
 
 // Start begins the discovery process
 func (d *Discovery) Start() error {
 	// Detect host IP
-	hostIP, err := d.detectHostIP()
-	if err != nil {
+	if err := d.DetectHostAddresses(); err != nil {
 		return fmt.Errorf("failed to detect host IP: %w", err)
 	}
-	d.hostIP = hostIP
-	
+
 	// Setup multicast connection
 	if err := d.setupMulticast(); err != nil {
 		return fmt.Errorf("failed to setup multicast: %w", err)
 	}
-	
-	log.Printf("Discovery started for stack %s on %s:%d", d.stackID, d.hostIP, d.port)
-	
+
+	replyPorts := make([]int, 0, len(d.groups))
+	for _, gc := range d.groups {
+		replyPorts = append(replyPorts, gc.replyPort)
+	}
+	log.Printf("Discovery started for stack %s on %v port %d, reply ports %v (authentication: %v, gossip: %v)",
+		d.StackID(), d.Addresses(), d.port, replyPorts, d.AuthEnabled(), d.gossipConfig != nil)
+
+	if d.gossipConfig != nil {
+		d.membership = gossip.NewMembership(d.StackID(), *d.gossipConfig, d, d.onMemberStateChange)
+		d.membership.Start()
+	}
+
 	// Start goroutines
-	d.wg.Add(3)
+	d.wg.Add(3 + 2*len(d.groups))
 	go d.announceLoop()
-	go d.listenLoop()
-	go d.cleanupLoop()
-	
+	for _, gc := range d.groups {
+		go d.listenLoop(gc.conn)
+		go d.listenLoop(gc.reply)
+	}
+	go d.maintenanceLoop()
+	go d.queryBurst()
+
 	return nil
 }
 
 // Stop stops the discovery process
 func (d *Discovery) Stop() error {
+	if d.membership != nil {
+		d.membership.Stop()
+	}
+	d.sendLeave()
 	d.cancel()
-	
-	if d.conn != nil {
-		d.conn.Close()
+
+	for _, gc := range d.groups {
+		gc.conn.Close()
+		gc.reply.Close()
 	}
-	
+
 	d.wg.Wait()
-	log.Printf("Discovery stopped for stack %s", d.stackID)
+	log.Printf("Discovery stopped for stack %s", d.StackID())
+	return nil
+}
+
+// setupMulticast opens and joins a multicast socket for every address family
+// that has a host address
+func (d *Discovery) setupMulticast() error {
+	for _, address := range d.Addresses() {
+		var gc *groupConn
+		var err error
+		if net.ParseIP(address).To4() != nil {
+			gc, err = d.setupGroup4()
+		} else {
+			gc, err = d.setupGroup6()
+		}
+		if err != nil {
+			return err
+		}
+		if err := gc.openReply(); err != nil {
+			gc.conn.Close()
+			return err
+		}
+		d.groups = append(d.groups, gc)
+	}
 	return nil
 }
 
-// detectHostIP detects the host's primary IP address
-func (d *Discovery) detectHostIP() (string, error) {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+// openReply opens the unicast reply socket on an ephemeral port of the
+// group's address family
+func (gc *groupConn) openReply() error {
+	network := "udp4"
+	if gc.group.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, nil)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("failed to open reply socket: %w", err)
 	}
-	defer conn.Close()
-	
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP.String(), nil
+	gc.reply = conn
+	gc.replyPort = conn.LocalAddr().(*net.UDPAddr).Port
+	return nil
 }
 
-// setupMulticast sets up the multicast connection
-func (d *Discovery) setupMulticast() error {
-	// Parse multicast group
-	group, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", d.multicastGroup, d.port))
+// replyAddr returns the address of the sender's reply socket, or nil when
+// the sender advertises none. The source port of its group messages is the
+// shared discovery port and cannot be used to reach it.
+func replyAddr(message *types.MulticastMessage, addr *net.UDPAddr) *net.UDPAddr {
+	if message.ReplyPort <= 0 || message.ReplyPort > 65535 {
+		return nil
+	}
+	return &net.UDPAddr{IP: addr.IP, Port: message.ReplyPort, Zone: addr.Zone}
+}
+
+// setupGroup4 sets up the IPv4 multicast connection
+func (d *Discovery) setupGroup4() (*groupConn, error) {
+	group, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(d.multicastGroup, fmt.Sprint(d.port)))
 	if err != nil {
-		return fmt.Errorf("failed to resolve multicast group: %w", err)
+		return nil, fmt.Errorf("failed to resolve multicast group: %w", err)
 	}
-	d.group = group
-	
+
 	// Create UDP connection with SO_REUSEPORT
-	conn, err := d.createUDPConnection()
+	conn, err := d.createUDPConnection(unix.AF_INET)
 	if err != nil {
-		return fmt.Errorf("failed to create UDP connection: %w", err)
+		return nil, fmt.Errorf("failed to create UDP connection: %w", err)
 	}
-	d.conn = conn
-	
-	// Create packet connection for multicast
+
 	packetConn := ipv4.NewPacketConn(conn)
-	d.packetConn = packetConn
-	
-	// Join multicast group
-	interfaces, err := net.Interfaces()
+	interfaces, err := d.joinGroup(func(iface *net.Interface) error {
+		return packetConn.JoinGroup(iface, group)
+	}, group)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &groupConn{
+		conn:       conn,
+		group:      group,
+		interfaces: interfaces,
+		writeTo: func(data []byte, ifIndex int, dst net.Addr) error {
+			_, err := packetConn.WriteTo(data, &ipv4.ControlMessage{IfIndex: ifIndex}, dst)
+			return err
+		},
+	}, nil
+}
+
+// setupGroup6 sets up the IPv6 multicast connection
+func (d *Discovery) setupGroup6() (*groupConn, error) {
+	group, err := net.ResolveUDPAddr("udp6", net.JoinHostPort(d.multicastGroup6, fmt.Sprint(d.port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve IPv6 multicast group: %w", err)
+	}
+	if !group.IP.IsMulticast() {
+		return nil, fmt.Errorf("%s is not an IPv6 multicast group", d.multicastGroup6)
+	}
+
+	conn, err := d.createUDPConnection(unix.AF_INET6)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create IPv6 UDP connection: %w", err)
+	}
+
+	packetConn := ipv6.NewPacketConn(conn)
+	interfaces, err := d.joinGroup(func(iface *net.Interface) error {
+		return packetConn.JoinGroup(iface, group)
+	}, group)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &groupConn{
+		conn:       conn,
+		group:      group,
+		interfaces: interfaces,
+		writeTo: func(data []byte, ifIndex int, dst net.Addr) error {
+			_, err := packetConn.WriteTo(data, &ipv6.ControlMessage{IfIndex: ifIndex}, dst)
+			return err
+		},
+	}, nil
+}
+
+// joinGroup joins the multicast group on every interface selected by the
+// interface filter and returns the interfaces it joined on
+func (d *Discovery) joinGroup(join func(iface *net.Interface) error, group *net.UDPAddr) ([]net.Interface, error) {
+	interfaces, err := netutil.MulticastInterfaces(d.interfaceFilter)
 	if err != nil {
-		return fmt.Errorf("failed to get interfaces: %w", err)
+		return nil, err
 	}
-	
+
+	var joined []net.Interface
 	for _, iface := range interfaces {
-		if iface.Flags&net.FlagMulticast != 0 && iface.Flags&net.FlagUp != 0 {
-			if err := packetConn.JoinGroup(&iface, group); err != nil {
-				log.Printf("Failed to join multicast group on %s: %v", iface.Name, err)
-				// Continue with other interfaces
-			} else {
-				log.Printf("Joined multicast group on interface %s", iface.Name)
-			}
+		if err := join(&iface); err != nil {
+			log.Printf("Failed to join multicast group %s on %s: %v", group.IP, iface.Name, err)
+			// Continue with other interfaces
+			continue
 		}
+		log.Printf("Joined multicast group %s on interface %s", group.IP, iface.Name)
+		joined = append(joined, iface)
 	}
-	
-	return nil
+
+	if len(joined) == 0 {
+		return nil, fmt.Errorf("multicast group %s could not be joined on any selected interface", group.IP)
+	}
+	return joined, nil
 }
 
-// createUDPConnection creates a UDP connection with SO_REUSEPORT enabled
-func (d *Discovery) createUDPConnection() (*net.UDPConn, error) {
+// createUDPConnection creates a UDP connection of the given address family
+// with SO_REUSEPORT enabled
+func (d *Discovery) createUDPConnection(domain int) (*net.UDPConn, error) {
 	// Create socket
-	sockFD, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
+	sockFD, err := unix.Socket(domain, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create socket: %w", err)
 	}
-	
+
 	// Enable SO_REUSEPORT
 	if err := unix.SetsockoptInt(sockFD, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
 		unix.Close(sockFD)
@@ -187,23 +378,32 @@ func (d *Discovery) createUDPConnection() (*net.UDPConn, error) {
 	} else {
 		log.Printf("SO_REUSEPORT enabled for port %d", d.port)
 	}
-	
+
 	// Enable SO_REUSEADDR for good measure
 	if err := unix.SetsockoptInt(sockFD, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
 		unix.Close(sockFD)
 		return nil, fmt.Errorf("failed to set SO_REUSEADDR: %w", err)
 	}
-	
+
 	// Bind to address
-	addr := &unix.SockaddrInet4{
+	var addr unix.Sockaddr = &unix.SockaddrInet4{
 		Port: d.port,
 		Addr: [4]byte{0, 0, 0, 0}, // INADDR_ANY
 	}
+	if domain == unix.AF_INET6 {
+		// Keep the IPv6 socket to IPv6 so it can share the port with the
+		// IPv4 socket in dual-stack mode
+		if err := unix.SetsockoptInt(sockFD, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 1); err != nil {
+			unix.Close(sockFD)
+			return nil, fmt.Errorf("failed to set IPV6_V6ONLY: %w", err)
+		}
+		addr = &unix.SockaddrInet6{Port: d.port} // in6addr_any
+	}
 	if err := unix.Bind(sockFD, addr); err != nil {
 		unix.Close(sockFD)
 		return nil, fmt.Errorf("failed to bind socket: %w", err)
 	}
-	
+
 	// Convert to net.UDPConn
 	file := os.NewFile(uintptr(sockFD), "")
 	conn, err := net.FileConn(file)
@@ -213,49 +413,88 @@ func (d *Discovery) createUDPConnection() (*net.UDPConn, error) {
 		return nil, fmt.Errorf("failed to create connection from file: %w", err)
 	}
 	file.Close()
-	
+
 	udpConn, ok := conn.(*net.UDPConn)
 	if !ok {
 		conn.Close()
 		return nil, fmt.Errorf("failed to convert to UDP connection")
 	}
-	
+
 	return udpConn, nil
 }
 
-// announceLoop periodically announces this peer's presence
+// announceLoop announces this peer's presence on the session's adaptive,
+// jittered schedule
 func (d *Discovery) announceLoop() {
 	defer d.wg.Done()
-	
-	ticker := time.NewTicker(d.announceInterval)
-	defer ticker.Stop()
-	
+
+	schedule := d.AnnounceSchedule()
+
 	// Send initial announcement
 	d.sendAnnouncement()
-	
+
 	for {
+		timer := time.NewTimer(schedule.Next())
 		select {
 		case <-d.ctx.Done():
+			timer.Stop()
 			return
-		case <-ticker.C:
-			d.sendAnnouncement()
+		case <-schedule.Resets():
+			// Start over at the fast interval after a topology change
+			timer.Stop()
+			continue
+		case <-timer.C:
 		}
+		d.sendAnnouncement()
 	}
 }
 
-// listenLoop listens for incoming multicast messages
-func (d *Discovery) listenLoop() {
+// queryBurst asks existing peers to identify themselves so a newly started
+// stack converges within the startup grace period instead of waiting for the
+// next periodic announcements. Queries are jittered across the window so
+// stacks started together do not query in lockstep, and repeated in case
+// one is lost.
+func (d *Discovery) queryBurst() {
 	defer d.wg.Done()
-	
-	buffer := make([]byte, MaxMessageSize)
-	
+
+	slot := d.startupGrace / StartupQueries
+	for i := 0; i < StartupQueries; i++ {
+		delay := time.Duration(0)
+		if i > 0 && slot > 0 {
+			delay = time.Duration(rand.Int63n(int64(slot)))
+		}
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		if err := d.sendToGroups(types.MessageTypeQuery); err != nil {
+			log.Printf("Error sending query: %v", err)
+		}
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(slot - delay):
+		}
+	}
+}
+
+// listenLoop listens for incoming multicast messages on one socket
+func (d *Discovery) listenLoop(conn *net.UDPConn) {
+	defer d.wg.Done()
+
+	buffer := make([]byte, protocol.ReadBufferSize)
+
 	for {
 		select {
 		case <-d.ctx.Done():
 			return
 		default:
-			d.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-			n, addr, err := d.conn.ReadFromUDP(buffer)
+			conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+			n, addr, err := conn.ReadFromUDP(buffer)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
@@ -263,27 +502,28 @@ func (d *Discovery) listenLoop() {
 				log.Printf("Error reading UDP message: %v", err)
 				continue
 			}
-			
+
 			d.handleMessage(buffer[:n], addr)
 		}
 	}
 }
 
-// cleanupLoop periodically cleans up stale peers
-func (d *Discovery) cleanupLoop() {
+// maintenanceLoop periodically expires replay protection state and
+// re-checks the host addresses, announcing at once when they change
+func (d *Discovery) maintenanceLoop() {
 	defer d.wg.Done()
-	
-	ticker := time.NewTicker(d.peerTimeout / 3)
+
+	ticker := time.NewTicker(d.announceInterval)
 	defer ticker.Stop()
-	
+
 	for {
 		select {
 		case <-d.ctx.Done():
 			return
 		case <-ticker.C:
-			d.storage.CleanupStale(d.peerTimeout)
-			if err := d.storage.WriteDiscoveryFile(); err != nil {
-				log.Printf("Error writing discovery file: %v", err)
+			d.Expire()
+			if d.RecheckHostAddresses() {
+				d.sendAnnouncement()
 			}
 		}
 	}
@@ -291,94 +531,203 @@ func (d *Discovery) cleanupLoop() {
 
 // sendAnnouncement sends an announcement message
 func (d *Discovery) sendAnnouncement() {
-	message := types.MulticastMessage{
-		Type:      types.MessageTypeAnnounce,
-		Version:   1,
-		StackID:   d.stackID,
-		HostIP:    d.hostIP,
-		VNI:       d.vni,
-		Timestamp: time.Now().Unix(),
-	}
-	
-	data, err := json.Marshal(message)
-	if err != nil {
-		log.Printf("Error marshaling announcement: %v", err)
+	if err := d.sendToGroups(types.MessageTypeAnnounce); err != nil {
+		log.Printf("Error sending announcement: %v", err)
+	}
+}
+
+// sendLeave tells peers we are going away so they withdraw us immediately
+// instead of waiting for the peer timeout
+func (d *Discovery) sendLeave() {
+	if len(d.groups) == 0 {
 		return
 	}
-	
-	_, err = d.conn.WriteToUDP(data, d.group)
+
+	for i := 0; i < protocol.LeaveRepeats; i++ {
+		if i > 0 {
+			time.Sleep(protocol.LeaveInterval)
+		}
+		if err := d.sendToGroups(types.MessageTypeLeave); err != nil {
+			log.Printf("Error sending leave: %v", err)
+			return
+		}
+	}
+	log.Printf("Sent leave for stack %s", d.StackID())
+}
+
+// newMessage builds a message carrying our gossip incarnation, so that
+// announcements and responses refute any suspicion about us
+func (d *Discovery) newMessage(messageType string) *types.MulticastMessage {
+	message := d.NewMessage(messageType)
+	if d.membership != nil {
+		message.Incarnation = d.membership.Incarnation()
+	}
+	return message
+}
+
+// sendToGroups sends a message of the given type to the group of every
+// address family, out of each selected interface separately. Each copy is
+// built separately so it gets its own sequence number; a receiver that hears
+// several copies would otherwise drop all but the first as replays.
+func (d *Discovery) sendToGroups(messageType string) error {
+	var errs []error
+	for _, gc := range d.groups {
+		for _, iface := range gc.interfaces {
+			message := d.newMessage(messageType)
+			message.ReplyPort = gc.replyPort
+			datagrams, err := d.Encode(message)
+			if err != nil {
+				return err
+			}
+			for _, data := range datagrams {
+				if err := gc.writeTo(data, iface.Index, gc.group); err != nil {
+					errs = append(errs, fmt.Errorf("failed to send %s message on %s: %w", messageType, iface.Name, err))
+					break
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SendMessage encodes and sends a message over the reply socket of the
+// destination's address family, so that answers come back to this stack
+func (d *Discovery) SendMessage(message *types.MulticastMessage, addr *net.UDPAddr) error {
+	isIPv4 := addr.IP.To4() != nil
+	for _, gc := range d.groups {
+		if (gc.group.IP.To4() != nil) == isIPv4 {
+			message.ReplyPort = gc.replyPort
+			return d.send(gc.reply, message, addr)
+		}
+	}
+	return fmt.Errorf("failed to send %s message: no socket for the address family of %s", message.Type, addr)
+}
+
+// send encodes and sends a message on the given socket
+func (d *Discovery) send(conn *net.UDPConn, message *types.MulticastMessage, addr *net.UDPAddr) error {
+	datagrams, err := d.Encode(message)
 	if err != nil {
-		log.Printf("Error sending announcement: %v", err)
+		return err
 	}
+
+	for _, data := range datagrams {
+		if _, err := conn.WriteToUDP(data, addr); err != nil {
+			return fmt.Errorf("failed to send %s message: %w", message.Type, err)
+		}
+	}
+	return nil
 }
 
 // handleMessage processes received multicast messages
 func (d *Discovery) handleMessage(data []byte, addr *net.UDPAddr) {
-	var message types.MulticastMessage
-	if err := json.Unmarshal(data, &message); err != nil {
-		log.Printf("Error unmarshaling message: %v", err)
-		return
-	}
-	
-	// Ignore messages from self
-	if message.StackID == d.stackID {
+	message, ok := d.Decode(data, addr)
+	if !ok {
 		return
 	}
-	
+
 	switch message.Type {
 	case types.MessageTypeAnnounce:
-		d.handleAnnouncement(&message, addr)
+		d.handleAnnouncement(message, addr)
 	case types.MessageTypeQuery:
-		d.handleQuery(&message, addr)
+		d.handleQuery(message, addr)
 	case types.MessageTypeResponse:
-		d.handleResponse(&message, addr)
+		d.handleResponse(message, addr)
+	case types.MessageTypeLeave:
+		d.handleLeave(message, addr)
+	case types.MessageTypePing, types.MessageTypePingReq, types.MessageTypeAck:
+		if d.membership != nil {
+			d.membership.HandleMessage(message, addr)
+		}
 	}
 }
 
+// onMemberStateChange reports gossip state changes as peer status events
+func (d *Discovery) onMemberStateChange(stackID, state string) {
+	peer := types.Peer{StackID: stackID, Status: gossip.PeerStatus(state)}
+	backend.Emit(d.ctx, d.events, backend.PeerEvent{Type: backend.EventPeerStatus, Peer: peer})
+}
+
 // handleAnnouncement processes announcement messages
 func (d *Discovery) handleAnnouncement(message *types.MulticastMessage, addr *net.UDPAddr) {
-	peer := &types.Peer{
-		StackID:      message.StackID,
-		HostIP:       message.HostIP,
-		VXLANEndpoint: fmt.Sprintf("%s:4789", message.HostIP),
-		VNI:          message.VNI,
-	}
-	
-	d.storage.AddPeer(peer)
+	peer, ok := d.PeerFromMessage(message, addr)
+	if !ok {
+		return
+	}
+
 	log.Printf("Discovered peer: %s (%s)", peer.StackID, peer.HostIP)
-	
-	// Write updated discovery file
-	if err := d.storage.WriteDiscoveryFile(); err != nil {
-		log.Printf("Error writing discovery file: %v", err)
+	if d.membership != nil {
+		d.membership.Alive(peer.StackID, replyAddr(message, addr), message.Incarnation)
 	}
+	backend.Emit(d.ctx, d.events, backend.PeerEvent{Type: backend.EventPeerUp, Peer: *peer, VNIs: d.SharedVNIs(message)})
+}
+
+// handleLeave withdraws a peer that announced it is shutting down
+func (d *Discovery) handleLeave(message *types.MulticastMessage, addr *net.UDPAddr) {
+	peer, ok := d.PeerFromMessage(message, addr)
+	if !ok {
+		return
+	}
+
+	log.Printf("Peer left: %s (%s)", peer.StackID, peer.HostIP)
+	if d.membership != nil {
+		d.membership.Leave(peer.StackID)
+	}
+	backend.Emit(d.ctx, d.events, backend.PeerEvent{Type: backend.EventPeerDown, Peer: *peer, VNIs: d.SharedVNIs(message)})
 }
 
 // handleQuery processes query messages
 func (d *Discovery) handleQuery(message *types.MulticastMessage, addr *net.UDPAddr) {
-	// Respond with our information
-	response := types.MulticastMessage{
-		Type:      types.MessageTypeResponse,
-		Version:   1,
-		StackID:   d.stackID,
-		HostIP:    d.hostIP,
-		VNI:       d.vni,
-		Timestamp: time.Now().Unix(),
-	}
-	
-	data, err := json.Marshal(response)
-	if err != nil {
-		log.Printf("Error marshaling response: %v", err)
+	// Respond with our information directly to the querier's reply port
+	// after a short random delay; Stop waits for pending responses and
+	// cancels them. Queriers that advertise no reply port can only be
+	// reached on the shared discovery port, where a sibling stack may
+	// receive the response instead, so they are answered on the group.
+	target := replyAddr(message, addr)
+	if target == nil && !d.allowGroupResponse() {
 		return
 	}
-	
-	_, err = d.conn.WriteToUDP(data, addr)
-	if err != nil {
-		log.Printf("Error sending response: %v", err)
+	delay := time.Duration(rand.Int63n(int64(MaxResponseDelay)))
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if target == nil {
+			if err := d.sendToGroups(types.MessageTypeResponse); err != nil {
+				log.Printf("Error sending response: %v", err)
+			}
+			return
+		}
+		response := d.newMessage(types.MessageTypeResponse)
+		if err := d.SendMessage(response, target); err != nil {
+			log.Printf("Error sending response: %v", err)
+		}
+	}()
+}
+
+// allowGroupResponse rate limits responses sent to the group, which every
+// peer receives, to one per GroupResponseInterval
+func (d *Discovery) allowGroupResponse() bool {
+	d.groupResponseMutex.Lock()
+	defer d.groupResponseMutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.lastGroupResponse) < GroupResponseInterval {
+		return false
 	}
+	d.lastGroupResponse = now
+	return true
 }
 
 // handleResponse processes response messages
 func (d *Discovery) handleResponse(message *types.MulticastMessage, addr *net.UDPAddr) {
 	// Same as announcement
 	d.handleAnnouncement(message, addr)
-}
\ No newline at end of file
+}
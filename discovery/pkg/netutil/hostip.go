@@ -0,0 +1,226 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Default route targets used when no host IP strategy is configured. No
+// packets are sent to them; they only select the route and source address.
+var (
+	defaultRouteTarget4 = net.ParseIP("8.8.8.8")
+	defaultRouteTarget6 = net.ParseIP("2001:4860:4860::8888")
+)
+
+// HostIPConfig selects how the host's underlay address is found. At most one
+// strategy may be set; with none, the source address of the default route is
+// used.
+type HostIPConfig struct {
+	// Addresses are explicit host addresses, at most one per family
+	Addresses []string
+	// Interface takes the first address of the named interface
+	Interface string
+	// Route takes the source address the kernel picks for a route to this
+	// CIDR or address, without sending any packets
+	Route string
+	// Subnet takes the first local address inside this CIDR
+	Subnet string
+}
+
+// Validate checks that at most one strategy is set and that its parameters
+// are well formed
+func (c HostIPConfig) Validate() error {
+	var set []string
+	if len(c.Addresses) > 0 {
+		set = append(set, "explicit address")
+		for _, address := range c.Addresses {
+			if net.ParseIP(address) == nil {
+				return fmt.Errorf("invalid host IP %q", address)
+			}
+		}
+	}
+	if c.Interface != "" {
+		set = append(set, "interface")
+		if _, err := net.InterfaceByName(c.Interface); err != nil {
+			return fmt.Errorf("host interface %q: %w", c.Interface, err)
+		}
+	}
+	if c.Route != "" {
+		set = append(set, "route")
+		if routeTarget(c.Route) == nil {
+			return fmt.Errorf("invalid host route target %q", c.Route)
+		}
+	}
+	if c.Subnet != "" {
+		set = append(set, "subnet")
+		if _, _, err := net.ParseCIDR(c.Subnet); err != nil {
+			return fmt.Errorf("invalid host subnet %q: %w", c.Subnet, err)
+		}
+	}
+
+	if len(set) > 1 {
+		return fmt.Errorf("only one host IP strategy may be configured, got %s", strings.Join(set, ", "))
+	}
+	return nil
+}
+
+// Strategy describes the configured strategy for log messages
+func (c HostIPConfig) Strategy() string {
+	switch {
+	case len(c.Addresses) > 0:
+		return "explicit"
+	case c.Interface != "":
+		return fmt.Sprintf("interface %s", c.Interface)
+	case c.Route != "":
+		return fmt.Sprintf("route to %s", c.Route)
+	case c.Subnet != "":
+		return fmt.Sprintf("subnet %s", c.Subnet)
+	default:
+		return "default route"
+	}
+}
+
+// Detect finds the host address of one family and checks that it is
+// assigned to a local interface
+func (c HostIPConfig) Detect(ipv6 bool) (net.IP, error) {
+	var ip net.IP
+	var err error
+	switch {
+	case len(c.Addresses) > 0:
+		ip, err = c.explicit(ipv6)
+	case c.Interface != "":
+		ip, err = interfaceIP(c.Interface, ipv6)
+	case c.Route != "":
+		ip, err = RouteSourceIP(routeTarget(c.Route))
+	case c.Subnet != "":
+		ip, err = subnetIP(c.Subnet, ipv6)
+	case ipv6:
+		ip, err = RouteSourceIP(defaultRouteTarget6)
+	default:
+		ip, err = RouteSourceIP(defaultRouteTarget4)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if (ip.To4() == nil) != ipv6 {
+		return nil, fmt.Errorf("%s gives %s, which is not an %s address", c.Strategy(), ip, familyName(ipv6))
+	}
+	if !IsLocalIP(ip) {
+		return nil, fmt.Errorf("host IP %s is not assigned to any local interface", ip)
+	}
+	return ip, nil
+}
+
+// explicit returns the configured address of the requested family
+func (c HostIPConfig) explicit(ipv6 bool) (net.IP, error) {
+	for _, address := range c.Addresses {
+		ip := net.ParseIP(address)
+		if ip != nil && (ip.To4() == nil) == ipv6 {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s address in HOST_IP", familyName(ipv6))
+}
+
+// RouteSourceIP returns the source address the kernel would use to reach
+// dest. It only consults the routing table; no packets are sent.
+func RouteSourceIP(dest net.IP) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dest, Port: 9})
+	if err != nil {
+		return nil, fmt.Errorf("no route to %s: %w", dest, err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// routeTarget returns the address to route to for a CIDR or plain address.
+// For a CIDR the first host address is used, since the network address
+// itself may not be routable.
+func routeTarget(value string) net.IP {
+	if ip := net.ParseIP(value); ip != nil {
+		return ip
+	}
+	ip, subnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil
+	}
+	if !ip.Equal(subnet.IP) {
+		return ip
+	}
+
+	target := make(net.IP, len(subnet.IP))
+	copy(target, subnet.IP)
+	target[len(target)-1]++
+	if !subnet.Contains(target) {
+		return subnet.IP
+	}
+	return target
+}
+
+// interfaceIP returns the first global unicast address of the requested
+// family on the named interface
+func interfaceIP(name string, ipv6 bool) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("host interface %q: %w", name, err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get addresses of %s: %w", name, err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.IsGlobalUnicast() && (ipNet.IP.To4() == nil) == ipv6 {
+			return ipNet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no %s address", name, familyName(ipv6))
+}
+
+// subnetIP returns the first local address inside the subnet
+func subnetIP(cidr string, ipv6 bool) (net.IP, error) {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host subnet %q: %w", cidr, err)
+	}
+	if (subnet.IP.To4() == nil) != ipv6 {
+		return nil, fmt.Errorf("host subnet %s is not an %s subnet", cidr, familyName(ipv6))
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interface addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && subnet.Contains(ipNet.IP) {
+			return ipNet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("no local address in subnet %s", cidr)
+}
+
+// IsLocalIP reports whether ip is assigned to one of this host's interfaces
+func IsLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func familyName(ipv6 bool) string {
+	if ipv6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
@@ -0,0 +1,120 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// interfacePattern matches an interface by name glob or by one of its
+// addresses falling inside a CIDR
+type interfacePattern struct {
+	glob   string
+	subnet *net.IPNet
+}
+
+// parsePattern parses a name glob such as "eth*" or a CIDR such as "10.0.0.0/8"
+func parsePattern(value string) (interfacePattern, error) {
+	if strings.Contains(value, "/") {
+		_, subnet, err := net.ParseCIDR(value)
+		if err != nil {
+			return interfacePattern{}, fmt.Errorf("invalid interface CIDR %q: %w", value, err)
+		}
+		return interfacePattern{subnet: subnet}, nil
+	}
+
+	if _, err := path.Match(value, ""); err != nil {
+		return interfacePattern{}, fmt.Errorf("invalid interface glob %q: %w", value, err)
+	}
+	return interfacePattern{glob: value}, nil
+}
+
+// match reports whether the interface matches the pattern
+func (p interfacePattern) match(iface *net.Interface) bool {
+	if p.subnet == nil {
+		matched, _ := path.Match(p.glob, iface.Name)
+		return matched
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && p.subnet.Contains(ipNet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// InterfaceFilter selects interfaces by an allowlist and a denylist of name
+// globs and CIDRs. An empty allowlist allows every interface; the denylist
+// wins over the allowlist.
+type InterfaceFilter struct {
+	include []interfacePattern
+	exclude []interfacePattern
+}
+
+// NewInterfaceFilter parses the include and exclude patterns
+func NewInterfaceFilter(include, exclude []string) (*InterfaceFilter, error) {
+	filter := &InterfaceFilter{}
+	for _, value := range include {
+		pattern, err := parsePattern(value)
+		if err != nil {
+			return nil, err
+		}
+		filter.include = append(filter.include, pattern)
+	}
+	for _, value := range exclude {
+		pattern, err := parsePattern(value)
+		if err != nil {
+			return nil, err
+		}
+		filter.exclude = append(filter.exclude, pattern)
+	}
+	return filter, nil
+}
+
+// Match reports whether the filter selects the interface
+func (f *InterfaceFilter) Match(iface *net.Interface) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, pattern := range f.exclude {
+		if pattern.match(iface) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pattern := range f.include {
+		if pattern.match(iface) {
+			return true
+		}
+	}
+	return false
+}
+
+// MulticastInterfaces returns the interfaces that are up, support multicast
+// and are selected by the filter
+func MulticastInterfaces(filter *InterfaceFilter) ([]net.Interface, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interfaces: %w", err)
+	}
+
+	var selected []net.Interface
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if filter.Match(&iface) {
+			selected = append(selected, iface)
+		}
+	}
+	return selected, nil
+}
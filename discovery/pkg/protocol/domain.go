@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+)
+
+const (
+	// DefaultDiscoveryPort is the discovery port used without a domain
+	DefaultDiscoveryPort = 4790
+	// domainPortRange is the number of ports domains are spread over,
+	// starting right above DefaultDiscoveryPort
+	domainPortRange = 1000
+)
+
+// domainHash hashes a domain name for deriving its defaults
+func domainHash(domain string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(domain))
+	return h.Sum32()
+}
+
+// DomainGroups derives the default IPv4 and IPv6 multicast groups of a
+// domain, so independent overlays on one LAN do not hear each other unless
+// configured to. The IPv4 group lies in the organization-local scope
+// 239.192.0.0/14, the IPv6 group in the site-local scope ff05::/16.
+func DomainGroups(domain string) (string, string) {
+	h := domainHash(domain)
+	group4 := net.IPv4(239, byte(192+(h>>16)&0x03), byte(h>>8), byte(h))
+	group6 := fmt.Sprintf("ff05::4790:%x:%x", h>>16, h&0xffff)
+	return group4.String(), group6
+}
+
+// DomainPort derives the default discovery port of a domain
+func DomainPort(domain string) int {
+	return DefaultDiscoveryPort + 1 + int(domainHash(domain)%domainPortRange)
+}
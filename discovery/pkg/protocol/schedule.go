@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAnnounceInterval is the steady-state announce interval
+	DefaultAnnounceInterval = 30 * time.Second
+	// DefaultFastAnnounceInterval is the announce interval right after
+	// startup or a topology change, before backing off
+	DefaultFastAnnounceInterval = 1 * time.Second
+	// AnnounceJitter is the fraction by which each announce interval is
+	// randomly lengthened or shortened, so stacks started together drift
+	// apart instead of announcing in lockstep
+	AnnounceJitter = 0.2
+)
+
+// AnnounceSchedule spaces announcements adaptively: it starts at a fast
+// interval and doubles it after every announcement up to the steady
+// interval. A topology change resets it to the fast interval.
+type AnnounceSchedule struct {
+	mutex   sync.Mutex
+	fast    time.Duration
+	steady  time.Duration
+	current time.Duration
+	resets  chan struct{}
+}
+
+// NewAnnounceSchedule creates a schedule backing off from fast to steady
+func NewAnnounceSchedule(fast, steady time.Duration) *AnnounceSchedule {
+	if fast > steady {
+		fast = steady
+	}
+	return &AnnounceSchedule{
+		fast:    fast,
+		steady:  steady,
+		current: fast,
+		resets:  make(chan struct{}, 1),
+	}
+}
+
+// Steady returns the interval the schedule backs off to; peers derive our
+// timeout from it
+func (a *AnnounceSchedule) Steady() time.Duration {
+	return a.steady
+}
+
+// Next returns the jittered delay until the next announcement and backs off
+func (a *AnnounceSchedule) Next() time.Duration {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	delay := a.current
+	a.current *= 2
+	if a.current > a.steady {
+		a.current = a.steady
+	}
+	return Jitter(delay, AnnounceJitter)
+}
+
+// Reset goes back to the fast interval after a topology change. Announce
+// loops waiting on Resets start over with the fast interval.
+func (a *AnnounceSchedule) Reset() {
+	a.mutex.Lock()
+	backedOff := a.current > a.fast
+	a.current = a.fast
+	a.mutex.Unlock()
+
+	if !backedOff {
+		return
+	}
+	select {
+	case a.resets <- struct{}{}:
+	default:
+	}
+}
+
+// Resets signals when the schedule was reset
+func (a *AnnounceSchedule) Resets() <-chan struct{} {
+	return a.resets
+}
+
+// Jitter randomly lengthens or shortens d by up to the given fraction
+func Jitter(d time.Duration, fraction float64) time.Duration {
+	return time.Duration(float64(d) * (1 + fraction*(2*rand.Float64()-1)))
+}
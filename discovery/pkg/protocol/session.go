@@ -0,0 +1,785 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker-router/discovery/pkg/auth"
+	"github.com/docker-router/discovery/pkg/metrics"
+	"github.com/docker-router/discovery/pkg/netutil"
+	"github.com/docker-router/discovery/pkg/ratelimit"
+	"github.com/docker-router/discovery/pkg/types"
+	"github.com/docker-router/discovery/pkg/wire"
+)
+
+const (
+	// VXLANPort is the UDP port peers terminate VXLAN tunnels on
+	VXLANPort = 4789
+	// LeaveRepeats is how many times a LEAVE is sent on shutdown, since UDP
+	// delivery is not guaranteed
+	LeaveRepeats = 3
+	// LeaveInterval is the spacing between repeated LEAVE messages
+	LeaveInterval = 100 * time.Millisecond
+	// PeerFeaturesTTL is how long the features a peer advertised are
+	// remembered after its last message
+	PeerFeaturesTTL = 5 * time.Minute
+	// MaxPeerFeatures bounds the number of peers whose features are
+	// tracked; further new peers are not tracked until others expire
+	MaxPeerFeatures = 4096
+	// DefaultMaxMessageSize is the largest datagram sent; larger messages
+	// are split into fragments
+	DefaultMaxMessageSize = 1024
+	// ReadBufferSize fits any UDP datagram, so oversized messages from peers
+	// are read whole instead of being truncated
+	ReadBufferSize = 65536
+)
+
+// Counter names reported by Session.Counters
+const (
+	CounterAuthUnsigned = "auth_unsigned"
+	CounterAuthInvalid  = "auth_invalid"
+	// CounterReplayPrefix is followed by the auth.Reason* that rejected the message
+	CounterReplayPrefix   = "replay_"
+	CounterSourceMismatch = "source_mismatch"
+	CounterParseError     = "parse_error"
+	CounterForeignVNI     = "foreign_vni"
+	CounterForeignDomain  = "foreign_domain"
+	// CounterUnsupportedVersion counts messages of a newer wire version
+	CounterUnsupportedVersion = "unsupported_version"
+	// CounterOversized counts datagrams received above the maximum message
+	// size and messages too large to send even in fragments
+	CounterOversized = "oversized"
+	// CounterReassembled counts messages reassembled from fragments
+	CounterReassembled = "reassembled"
+	// CounterFragmentError counts malformed fragments and fragments dropped
+	// because too many messages were being reassembled
+	CounterFragmentError = "fragment_error"
+	// CounterFragmentsExpired counts messages whose fragments did not all
+	// arrive in time
+	CounterFragmentsExpired = "fragments_expired"
+	// CounterRateLimited counts datagrams dropped by the per-source rate limit
+	CounterRateLimited = "rate_limited"
+	// CounterDuplicateStackID counts accepted messages from another host
+	// announcing our stack ID
+	CounterDuplicateStackID = "duplicate_stack_id"
+)
+
+// Family selects the address families discovery runs over
+type Family string
+
+const (
+	FamilyIPv4 Family = "ipv4"
+	FamilyIPv6 Family = "ipv6"
+	// FamilyDual announces both an IPv4 and an IPv6 address; IPv4 is the
+	// primary host IP
+	FamilyDual Family = "dual"
+)
+
+// ParseFamily parses an address family name, defaulting to IPv4
+func ParseFamily(name string) (Family, error) {
+	switch Family(name) {
+	case "", FamilyIPv4:
+		return FamilyIPv4, nil
+	case FamilyIPv6, FamilyDual:
+		return Family(name), nil
+	default:
+		return "", fmt.Errorf("unknown address family %q (want ipv4, ipv6 or dual)", name)
+	}
+}
+
+// HasIPv4 reports whether the family includes IPv4
+func (f Family) HasIPv4() bool {
+	return f != FamilyIPv6
+}
+
+// HasIPv6 reports whether the family includes IPv6
+func (f Family) HasIPv6() bool {
+	return f == FamilyIPv6 || f == FamilyDual
+}
+
+// WireFormat selects how outgoing messages are encoded
+type WireFormat string
+
+const (
+	WireFormatJSON   WireFormat = "json"
+	WireFormatBinary WireFormat = "binary"
+	// WireFormatAuto sends binary messages once every known peer has
+	// advertised that it decodes them, and JSON otherwise
+	WireFormatAuto WireFormat = "auto"
+)
+
+// ParseWireFormat parses a wire format name, defaulting to auto
+func ParseWireFormat(name string) (WireFormat, error) {
+	switch WireFormat(name) {
+	case "", WireFormatAuto:
+		return WireFormatAuto, nil
+	case WireFormatJSON, WireFormatBinary:
+		return WireFormat(name), nil
+	default:
+		return "", fmt.Errorf("unknown wire format %q (want auto, json or binary)", name)
+	}
+}
+
+// peerFeatures is what a peer advertised in its last message
+type peerFeatures struct {
+	features wire.Features
+	seen     time.Time
+}
+
+// Session holds the local identity and the message security state shared by
+// all discovery transports: it builds, signs and encodes outgoing messages and
+// decodes and admits incoming ones
+type Session struct {
+	stackID      string
+	domain       string
+	hostIP       string
+	addresses    []string
+	family       Family
+	hostIPConfig netutil.HostIPConfig
+	// mutex guards hostIP and addresses, which change when a re-check
+	// finds new host addresses
+	mutex sync.RWMutex
+	// vnis are the overlays this stack serves, the primary one first
+	vnis       []int
+	vxlanIP    string
+	subnets    []string
+	labels     map[string]string
+	wireFormat WireFormat
+	// peerFeatures tracks the features each peer advertised, to decide
+	// whether binary messages are understood by everyone
+	peerFeatures     map[string]peerFeatures
+	binaryNegotiated bool
+	featuresMutex    sync.Mutex
+	reassembler      *wire.Reassembler
+	maxMessageSize   int
+	fragmentID       uint64
+	// limiter rate limits incoming datagrams per source IP; nil disables it
+	limiter       *ratelimit.Limiter
+	schedule      *AnnounceSchedule
+	authenticator *auth.Authenticator
+	replayGuard   *auth.ReplayGuard
+	sourceMode    auth.SourceMode
+	counters      *metrics.Counters
+	seq           uint64
+}
+
+// NewSession creates a session for the given stack and VNI
+func NewSession(stackID string, vni int) *Session {
+	session := &Session{
+		stackID:        stackID,
+		vnis:           []int{vni},
+		family:         FamilyIPv4,
+		wireFormat:     WireFormatAuto,
+		peerFeatures:   make(map[string]peerFeatures),
+		reassembler:    wire.NewReassembler(wire.DefaultFragmentTimeout),
+		maxMessageSize: DefaultMaxMessageSize,
+		limiter:        ratelimit.NewLimiter(ratelimit.DefaultRate, ratelimit.DefaultBurst),
+		schedule:       NewAnnounceSchedule(DefaultFastAnnounceInterval, DefaultAnnounceInterval),
+		replayGuard:    auth.NewReplayGuard(auth.DefaultMaxClockSkew),
+		sourceMode:     auth.SourceModeOff,
+		counters:       metrics.NewCounters(),
+		// Seeding from the clock keeps sequence numbers increasing across restarts
+		seq:        uint64(time.Now().UnixNano()),
+		fragmentID: uint64(time.Now().UnixNano()),
+	}
+	session.reassembler.SetMaxFragmentSize(DefaultMaxMessageSize)
+	return session
+}
+
+// StackID returns the local stack ID
+func (s *Session) StackID() string {
+	return s.stackID
+}
+
+// HostIP returns the advertised host IP
+func (s *Session) HostIP() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.hostIP
+}
+
+// SetHostIP sets the advertised host IP
+func (s *Session) SetHostIP(hostIP string) {
+	s.setAddresses([]string{hostIP})
+}
+
+// Addresses returns every advertised underlay address, host IP first
+func (s *Session) Addresses() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(s.addresses) == 0 && s.hostIP != "" {
+		return []string{s.hostIP}
+	}
+	return s.addresses
+}
+
+// Family returns the address families discovery runs over
+func (s *Session) Family() Family {
+	return s.family
+}
+
+// SetFamily sets the address families discovery runs over
+func (s *Session) SetFamily(family Family) {
+	s.family = family
+}
+
+// SetHostIPConfig sets how the host addresses are found
+func (s *Session) SetHostIPConfig(config netutil.HostIPConfig) {
+	s.hostIPConfig = config
+}
+
+// DetectHostAddresses detects the host's address of every configured family
+// with the configured strategy and advertises them. In dual-stack mode a
+// family without an address is skipped as long as the other one has one.
+func (s *Session) DetectHostAddresses() error {
+	addresses, err := s.detectAddresses()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Detected host addresses %v (strategy: %s)", addresses, s.hostIPConfig.Strategy())
+	s.setAddresses(addresses)
+	return nil
+}
+
+// RecheckHostAddresses detects the host addresses again and advertises them
+// if they changed, e.g. after a DHCP renewal or failover. If detection fails
+// the previous addresses are kept. It reports whether the addresses changed.
+func (s *Session) RecheckHostAddresses() bool {
+	addresses, err := s.detectAddresses()
+	if err != nil {
+		log.Printf("Warning: host address re-check failed, keeping %v: %v", s.Addresses(), err)
+		return false
+	}
+
+	previous := s.Addresses()
+	if strings.Join(addresses, ",") == strings.Join(previous, ",") {
+		return false
+	}
+	log.Printf("Host addresses changed from %v to %v (strategy: %s)", previous, addresses, s.hostIPConfig.Strategy())
+	s.setAddresses(addresses)
+	s.schedule.Reset()
+	return true
+}
+
+// detectAddresses detects the host address of each configured family,
+// primary first
+func (s *Session) detectAddresses() ([]string, error) {
+	var addresses []string
+	var errs []error
+	for _, ipv6 := range []bool{false, true} {
+		if (ipv6 && !s.family.HasIPv6()) || (!ipv6 && !s.family.HasIPv4()) {
+			continue
+		}
+		ip, err := s.hostIPConfig.Detect(ipv6)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		addresses = append(addresses, ip.String())
+	}
+
+	if len(addresses) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	for _, err := range errs {
+		log.Printf("Warning: skipping address family: %v", err)
+	}
+	return addresses, nil
+}
+
+// setAddresses advertises the detected addresses, the first one as host IP
+func (s *Session) setAddresses(addresses []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.hostIP = addresses[0]
+	s.addresses = nil
+	if len(addresses) > 1 {
+		s.addresses = addresses
+	}
+}
+
+// Domain returns the discovery domain
+func (s *Session) Domain() string {
+	return s.domain
+}
+
+// SetDomain scopes discovery to a domain: outgoing messages carry it and
+// messages from other domains are ignored
+func (s *Session) SetDomain(domain string) {
+	s.domain = domain
+}
+
+// VNIs returns the overlays this stack serves, the primary one first
+func (s *Session) VNIs() []int {
+	return s.vnis
+}
+
+// SetVNIs sets the overlays this stack serves; peers that share none of them
+// are ignored
+func (s *Session) SetVNIs(vnis []int) {
+	if len(vnis) > 0 {
+		s.vnis = vnis
+	}
+}
+
+// advertisedVNIs returns the VNI list to put in messages; it is left out
+// when the stack serves a single VNI, which the VNI field already carries
+func (s *Session) advertisedVNIs() []int {
+	if len(s.vnis) < 2 {
+		return nil
+	}
+	return s.vnis
+}
+
+// SharedVNIs returns the overlays served by both this stack and the sender
+// of the message
+func (s *Session) SharedVNIs(message *types.MulticastMessage) []int {
+	senderVNIs := message.VNIs
+	if len(senderVNIs) == 0 {
+		senderVNIs = []int{message.VNI}
+	}
+
+	var shared []int
+	for _, vni := range s.vnis {
+		for _, senderVNI := range senderVNIs {
+			if vni == senderVNI {
+				shared = append(shared, vni)
+				break
+			}
+		}
+	}
+	return shared
+}
+
+// SetAdvertisedRoutes sets the overlay address and container subnets
+// announced to peers
+func (s *Session) SetAdvertisedRoutes(vxlanIP string, subnets []string) {
+	s.vxlanIP = vxlanIP
+	s.subnets = subnets
+}
+
+// SetLabels sets the key/value pairs announced to peers
+func (s *Session) SetLabels(labels map[string]string) {
+	s.labels = labels
+}
+
+// SetWireFormat sets how outgoing messages are encoded. Incoming messages
+// are accepted in either format.
+func (s *Session) SetWireFormat(format WireFormat) {
+	s.wireFormat = format
+}
+
+// SetMaxMessageSize sets the largest datagram sent; larger messages are
+// fragmented. Peers use the same limit, so larger fragments are rejected.
+func (s *Session) SetMaxMessageSize(size int) {
+	s.maxMessageSize = size
+	s.reassembler.SetMaxFragmentSize(size)
+}
+
+// SetAnnounceInterval sets the steady-state announce interval, which is
+// advertised to peers so they can derive our timeout from it
+func (s *Session) SetAnnounceInterval(interval time.Duration) {
+	s.schedule = NewAnnounceSchedule(s.schedule.fast, interval)
+}
+
+// SetFastAnnounceInterval sets the announce interval used after startup and
+// topology changes, before backing off to the steady-state interval
+func (s *Session) SetFastAnnounceInterval(interval time.Duration) {
+	s.schedule = NewAnnounceSchedule(interval, s.schedule.steady)
+}
+
+// AnnounceSchedule returns the schedule announce loops should follow
+func (s *Session) AnnounceSchedule() *AnnounceSchedule {
+	return s.schedule
+}
+
+// SetRateLimit sets how many datagrams per second, with the given burst, are
+// processed from one source IP; excess datagrams are dropped before they are
+// parsed. A rate of zero disables the limit.
+func (s *Session) SetRateLimit(rate float64, burst int) {
+	if rate <= 0 {
+		s.limiter = nil
+		return
+	}
+	s.limiter = ratelimit.NewLimiter(rate, burst)
+}
+
+// Features returns the optional protocol features this stack supports
+func (s *Session) Features() wire.Features {
+	features := wire.FeatureBinary | wire.FeatureMultiVNI | wire.FeatureSubnets | wire.FeatureLabels | wire.FeatureFragments
+	if s.authenticator != nil {
+		features |= wire.FeatureAuth
+	}
+	return features
+}
+
+// recordFeatures remembers the features a peer advertised. JSON peers
+// predating feature flags advertise none and so keep the cluster on JSON.
+// A peer appearing or leaving is a topology change, which speeds up the
+// announce schedule so the change converges quickly. Only peers accepted by
+// PeerFromMessage are recorded.
+func (s *Session) recordFeatures(message *types.MulticastMessage) {
+	s.featuresMutex.Lock()
+	defer s.featuresMutex.Unlock()
+
+	_, known := s.peerFeatures[message.StackID]
+	if message.Type == types.MessageTypeLeave {
+		delete(s.peerFeatures, message.StackID)
+		if known {
+			s.schedule.Reset()
+		}
+		return
+	}
+	if !known {
+		if len(s.peerFeatures) >= MaxPeerFeatures {
+			return
+		}
+		s.schedule.Reset()
+	}
+	s.peerFeatures[message.StackID] = peerFeatures{
+		features: wire.Features(message.Features),
+		seen:     time.Now(),
+	}
+}
+
+// sendBinary reports whether outgoing messages use the binary format. In
+// auto mode that needs at least one known peer, all of which decode it.
+func (s *Session) sendBinary() bool {
+	switch s.wireFormat {
+	case WireFormatBinary:
+		return true
+	case WireFormatJSON:
+		return false
+	}
+
+	s.featuresMutex.Lock()
+	defer s.featuresMutex.Unlock()
+	binary := len(s.peerFeatures) > 0
+	for _, peer := range s.peerFeatures {
+		if !peer.features.Has(wire.FeatureBinary) {
+			binary = false
+			break
+		}
+	}
+	if binary != s.binaryNegotiated {
+		s.binaryNegotiated = binary
+		if binary {
+			log.Printf("All %d known peers decode the binary wire format, switching to it", len(s.peerFeatures))
+		} else if len(s.peerFeatures) > 0 {
+			log.Printf("Not every known peer decodes the binary wire format, switching to JSON")
+		}
+	}
+	return binary
+}
+
+// SetAuthenticator enables HMAC signing of outgoing messages and rejects
+// incoming messages that are unsigned or fail verification
+func (s *Session) SetAuthenticator(authenticator *auth.Authenticator) {
+	s.authenticator = authenticator
+}
+
+// AuthEnabled reports whether messages are signed and verified
+func (s *Session) AuthEnabled() bool {
+	return s.authenticator != nil
+}
+
+// SetMaxClockSkew sets how far a message timestamp may differ from the local
+// clock before the message is rejected as stale (zero disables the check)
+func (s *Session) SetMaxClockSkew(skew time.Duration) {
+	s.replayGuard = auth.NewReplayGuard(skew)
+}
+
+// SetSourceMode sets how announcement source addresses are checked against
+// the advertised host IP
+func (s *Session) SetSourceMode(mode auth.SourceMode) {
+	s.sourceMode = mode
+}
+
+// Counters returns a snapshot of the session counters
+func (s *Session) Counters() map[string]uint64 {
+	return s.counters.Snapshot()
+}
+
+// IncCounter increments a session counter
+func (s *Session) IncCounter(name string) {
+	s.counters.Inc(name)
+}
+
+// Expire drops replay state that can no longer be used, incomplete
+// fragmented messages and the features of peers that went quiet
+func (s *Session) Expire() {
+	s.replayGuard.Expire()
+	if s.limiter != nil {
+		s.limiter.Expire()
+	}
+	if expired := s.reassembler.Expire(); expired > 0 {
+		s.counters.Add(CounterFragmentsExpired, uint64(expired))
+	}
+
+	s.featuresMutex.Lock()
+	defer s.featuresMutex.Unlock()
+	for stackID, peer := range s.peerFeatures {
+		if time.Since(peer.seen) > PeerFeaturesTTL {
+			delete(s.peerFeatures, stackID)
+		}
+	}
+}
+
+// NewMessage builds a message of the given type describing this peer
+func (s *Session) NewMessage(messageType string) *types.MulticastMessage {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return &types.MulticastMessage{
+		Type:      messageType,
+		Version:   wire.VersionJSON,
+		Features:  uint64(s.Features()),
+		StackID:   s.stackID,
+		Domain:    s.domain,
+		HostIP:    s.hostIP,
+		Addresses: s.addresses,
+		VXLANIP:   s.vxlanIP,
+		Subnets:   s.subnets,
+		Labels:    s.labels,
+		VNI:       s.vnis[0],
+		VNIs:      s.advertisedVNIs(),
+		Timestamp: time.Now().Unix(),
+		Seq:       atomic.AddUint64(&s.seq, 1),
+		// Round up so a sub-second interval is not advertised as none
+		AnnounceInterval: int((s.schedule.Steady() + time.Second - 1) / time.Second),
+	}
+}
+
+// Encode signs the message (when authentication is enabled), encodes it in
+// the negotiated wire format and splits it into datagrams no larger than the
+// maximum message size
+func (s *Session) Encode(message *types.MulticastMessage) ([][]byte, error) {
+	data, err := s.marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	datagrams, err := wire.Fragment(data, atomic.AddUint64(&s.fragmentID, 1), s.maxMessageSize)
+	if err != nil {
+		s.counters.Inc(CounterOversized)
+		return nil, fmt.Errorf("failed to fragment %s message: %w", message.Type, err)
+	}
+	return datagrams, nil
+}
+
+// marshal encodes a message and, when authentication is enabled, wraps it
+// in a signed envelope
+func (s *Session) marshal(message *types.MulticastMessage) ([]byte, error) {
+	binary := s.sendBinary()
+	if binary {
+		message.Version = wire.VersionBinary
+	}
+
+	if s.authenticator != nil {
+		if err := auth.SetNonce(message); err != nil {
+			return nil, fmt.Errorf("failed to sign %s message: %w", message.Type, err)
+		}
+	}
+
+	var data []byte
+	var err error
+	if binary {
+		data, err = wire.Marshal(message)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s message: %w", message.Type, err)
+		}
+	} else {
+		data, err = json.Marshal(message)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s message: %w", message.Type, err)
+		}
+	}
+
+	if s.authenticator != nil {
+		data = wire.Seal(s.authenticator.Sign(data), data)
+	}
+	return data, nil
+}
+
+// Decode rate limits a received datagram, parses it in either wire format,
+// reassembling fragmented messages, and admits it through authentication and
+// replay protection. It returns false for our own
+// messages and for messages that were rejected; rejections are logged and
+// counted.
+func (s *Session) Decode(data []byte, addr *net.UDPAddr) (*types.MulticastMessage, bool) {
+	// Drop floods before spending any work on them
+	if s.limiter != nil {
+		if allowed, started := s.limiter.Allow(addr.IP.String()); !allowed {
+			s.counters.Inc(CounterRateLimited)
+			if started {
+				log.Printf("Rate limiting messages from %s", addr.IP)
+			}
+			return nil, false
+		}
+	}
+
+	if len(data) > s.maxMessageSize {
+		s.counters.Inc(CounterOversized)
+	}
+
+	// Hold fragments back until the whole message has arrived
+	if wire.IsFragment(data) {
+		complete, err := s.reassembler.Add(addr.String(), data)
+		if err != nil {
+			s.counters.Inc(CounterFragmentError)
+			log.Printf("Dropping fragment from %s: %v", addr, err)
+			return nil, false
+		}
+		if complete == nil {
+			return nil, false
+		}
+		s.counters.Inc(CounterReassembled)
+		data = complete
+	}
+
+	// Unwrap signed messages; the signature is checked once the message
+	// is known to be for us
+	var signature []byte
+	if wire.IsSigned(data) {
+		payload, sig, err := wire.Open(data)
+		if err != nil {
+			s.counters.Inc(CounterParseError)
+			log.Printf("Error unmarshaling message from %s: %v", addr, err)
+			return nil, false
+		}
+		data, signature = payload, sig
+	}
+
+	var message types.MulticastMessage
+	var err error
+	if wire.IsBinary(data) {
+		err = wire.Unmarshal(data, &message)
+	} else {
+		err = json.Unmarshal(data, &message)
+		if err == nil && message.Version > wire.VersionJSON {
+			err = &wire.VersionError{Version: message.Version}
+		}
+	}
+	if err != nil {
+		if _, ok := err.(*wire.VersionError); ok {
+			s.counters.Inc(CounterUnsupportedVersion)
+			log.Printf("Ignoring message from %s: %v", addr, err)
+			return nil, false
+		}
+		s.counters.Inc(CounterParseError)
+		log.Printf("Error unmarshaling message from %s: %v", addr, err)
+		return nil, false
+	}
+
+	// Ignore messages from self. Another host announcing our stack ID is
+	// passed on, so that it is reported as a conflict.
+	if message.StackID == s.stackID && s.isSelf(&message) {
+		return nil, false
+	}
+
+	// Ignore other overlays sharing the network; this is expected traffic,
+	// so it is only counted
+	if message.Domain != s.domain {
+		s.counters.Inc(CounterForeignDomain)
+		return nil, false
+	}
+
+	// Drop messages that are not signed with an accepted key
+	if s.authenticator != nil {
+		if err := s.authenticator.Verify(data, signature); err != nil {
+			counter := CounterAuthInvalid
+			if err == auth.ErrUnsigned {
+				counter = CounterAuthUnsigned
+			}
+			s.counters.Inc(counter)
+			LogRejection(counter, &message, addr, err.Error())
+			return nil, false
+		}
+	}
+
+	// Drop stale, future-dated and replayed messages
+	if err := s.replayGuard.Check(&message); err != nil {
+		reason := "replay"
+		if rejectErr, ok := err.(*auth.RejectError); ok {
+			reason = rejectErr.Reason
+			s.counters.Inc(CounterReplayPrefix + reason)
+		}
+		LogRejection(reason, &message, addr, err.Error())
+		return nil, false
+	}
+
+	return &message, true
+}
+
+// isSelf reports whether a message carrying our stack ID was sent by us,
+// judged by the host IP and addresses it advertises
+func (s *Session) isSelf(message *types.MulticastMessage) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if message.HostIP != s.hostIP || len(message.Addresses) != len(s.addresses) {
+		return false
+	}
+	for i, address := range message.Addresses {
+		if address != s.addresses[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// PeerFromMessage converts an announcement or response into a peer record,
+// applying source address verification. Peers that share no VNI with this
+// stack are rejected, so foreign overlays never reach the discovery files.
+// The peer's VNI is the first shared one; SharedVNIs lists them all.
+// Accepted peers' features are recorded for wire format negotiation. It
+// returns false if the message was rejected.
+func (s *Session) PeerFromMessage(message *types.MulticastMessage, addr *net.UDPAddr) (*types.Peer, bool) {
+	shared := s.SharedVNIs(message)
+	if len(shared) == 0 {
+		s.counters.Inc(CounterForeignVNI)
+		return nil, false
+	}
+
+	reflexiveIP, err := auth.CheckSource(s.sourceMode, message, addr)
+	if err != nil {
+		s.counters.Inc(CounterSourceMismatch)
+		LogRejection(CounterSourceMismatch, message, addr, err.Error())
+		return nil, false
+	}
+	s.recordFeatures(message)
+
+	if message.StackID == s.stackID {
+		s.counters.Inc(CounterDuplicateStackID)
+		log.Printf("Stack ID %s is also announced by %s (%s)", message.StackID, message.HostIP, addr)
+	}
+
+	return &types.Peer{
+		StackID:          message.StackID,
+		HostIP:           message.HostIP,
+		VXLANEndpoint:    net.JoinHostPort(message.HostIP, fmt.Sprint(VXLANPort)),
+		ReflexiveIP:      reflexiveIP,
+		Addresses:        message.Addresses,
+		VXLANIP:          message.VXLANIP,
+		Subnets:          message.Subnets,
+		Labels:           message.Labels,
+		Features:         wire.Features(message.Features).Names(),
+		AnnounceInterval: message.AnnounceInterval,
+		VNI:              shared[0],
+	}, true
+}
+
+// LogRejection logs a dropped message as key=value pairs so rejections can be
+// filtered and aggregated by reason
+func LogRejection(reason string, message *types.MulticastMessage, addr *net.UDPAddr, detail string) {
+	log.Printf("Rejected message: reason=%s type=%s stack_id=%s host_ip=%s source=%s seq=%d timestamp=%d detail=%q",
+		reason, message.Type, message.StackID, message.HostIP, addr, message.Seq, message.Timestamp, detail)
+}
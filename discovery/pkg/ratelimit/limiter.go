@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRate is the default number of datagrams per second allowed from
+	// one source
+	DefaultRate = 20
+	// DefaultBurst is the default number of datagrams a source may send at
+	// once; it covers a fully fragmented message
+	DefaultBurst = 100
+	// MaxSources bounds the number of sources tracked at once. Datagrams
+	// from new sources beyond it are dropped until idle sources expire.
+	MaxSources = 4096
+)
+
+// bucket is the token bucket of one source
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// limited is set while the source is being dropped
+	limited bool
+}
+
+// Limiter rate limits traffic per source with a token bucket each. A bucket
+// holds up to burst tokens and refills at rate tokens per second; every
+// datagram takes one token.
+type Limiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+// NewLimiter creates a limiter allowing rate datagrams per second with the
+// given burst from every source
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the source's bucket and reports whether the
+// datagram may be processed. started is true for the first dropped datagram
+// after the source was last allowed through, so callers can log once per
+// burst of excess traffic.
+func (l *Limiter) Allow(source string) (allowed bool, started bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	b, exists := l.buckets[source]
+	if !exists {
+		if len(l.buckets) >= MaxSources && l.expire(now) == 0 {
+			return false, false
+		}
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[source] = b
+	}
+
+	b.tokens += now.Sub(b.updated).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.updated = now
+
+	if b.tokens < 1 {
+		started = !b.limited
+		b.limited = true
+		return false, started
+	}
+	b.tokens--
+	b.limited = false
+	return true, false
+}
+
+// Expire forgets sources whose buckets have refilled completely, since they
+// behave the same as new sources
+func (l *Limiter) Expire() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.expire(time.Now())
+}
+
+// expire drops full buckets and returns how many were dropped; the caller
+// must hold the mutex
+func (l *Limiter) expire(now time.Time) int {
+	expired := 0
+	for source, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, source)
+			expired++
+		}
+	}
+	return expired
+}
@@ -0,0 +1,186 @@
+package static
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/docker-router/discovery/pkg/backend"
+	"github.com/docker-router/discovery/pkg/netutil"
+	"github.com/docker-router/discovery/pkg/protocol"
+	"github.com/docker-router/discovery/pkg/storage"
+	"github.com/docker-router/discovery/pkg/types"
+	"github.com/docker-router/schema"
+)
+
+const (
+	DefaultPeersFile       = "/etc/discovery/peers.json"
+	DefaultRefreshInterval = 30 * time.Second
+	// SourceName is recorded as the source of peers read from the peers file
+	SourceName = "static"
+)
+
+// peersFile is the format of an unversioned static peers file, which lists
+// peers in the version 1 discovery file layout. Files with a version are
+// read like discovery.json, so a copy of any version can be used.
+type peersFile struct {
+	Peers []types.Peer `json:"peers"`
+}
+
+// Backend reports peers listed in a static JSON file and implements
+// backend.Backend. The file is re-read periodically, so peers can be added or
+// removed without restarting the daemon.
+type Backend struct {
+	path            string
+	vni             int
+	refreshInterval time.Duration
+	events          chan backend.PeerEvent
+	known           map[string]bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewBackend creates a static peers backend. Peers without a VNI in the file
+// are assigned vni.
+func NewBackend(path string, vni int) *Backend {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if path == "" {
+		path = DefaultPeersFile
+	}
+
+	return &Backend{
+		path:            path,
+		vni:             vni,
+		refreshInterval: DefaultRefreshInterval,
+		events:          make(chan backend.PeerEvent, backend.EventBufferSize),
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+}
+
+// SetRefreshInterval sets how often the peers file is re-read
+func (b *Backend) SetRefreshInterval(interval time.Duration) {
+	b.refreshInterval = interval
+}
+
+// Name returns the backend name
+func (b *Backend) Name() string {
+	return SourceName
+}
+
+// Events returns the stream of peers read from the file
+func (b *Backend) Events() <-chan backend.PeerEvent {
+	return b.events
+}
+
+// Start begins reporting peers from the file
+func (b *Backend) Start() error {
+	log.Printf("Static discovery started from %s", b.path)
+
+	b.wg.Add(1)
+	go b.refreshLoop()
+	return nil
+}
+
+// Stop stops the backend
+func (b *Backend) Stop() error {
+	b.cancel()
+	b.wg.Wait()
+	log.Printf("Static discovery stopped")
+	return nil
+}
+
+// refreshLoop periodically re-reads the peers file
+func (b *Backend) refreshLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		b.refresh()
+
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh loads the peers file and reports its contents
+func (b *Backend) refresh() {
+	peers, err := b.load()
+	if err != nil {
+		// Keep reporting the last known peers until the file is readable again
+		log.Printf("Error reading static peers file: %v", err)
+		return
+	}
+
+	b.known = backend.EmitSnapshot(b.ctx, b.events, b.known, peers)
+}
+
+// load parses the peers file, skipping invalid entries and this host
+func (b *Backend) load() ([]types.Peer, error) {
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", b.path, err)
+	}
+
+	entries, err := decodePeers(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", b.path, err)
+	}
+
+	var peers []types.Peer
+	for _, peer := range entries {
+		ip := net.ParseIP(peer.HostIP)
+		if peer.StackID == "" || ip == nil {
+			log.Printf("Skipping invalid static peer %q (%s)", peer.StackID, peer.HostIP)
+			continue
+		}
+		if netutil.IsLocalIP(ip) {
+			continue
+		}
+
+		if peer.VNI == 0 {
+			peer.VNI = b.vni
+		}
+		if peer.VXLANEndpoint == "" {
+			peer.VXLANEndpoint = net.JoinHostPort(peer.HostIP, fmt.Sprint(protocol.VXLANPort))
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// decodePeers parses the peers of a static peers file
+func decodePeers(data []byte) ([]types.Peer, error) {
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	if header.Version == 0 {
+		var file peersFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, err
+		}
+		return file.Peers, nil
+	}
+
+	discoveryData, err := schema.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return storage.FromSchema(discoveryData.Peers), nil
+}
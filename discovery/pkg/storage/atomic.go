@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// HistoryDir is the subdirectory of the data directory keeping previous
+	// generations of the discovery files
+	HistoryDir = "history"
+	// DefaultHistory is how many generations of a discovery file are kept
+	DefaultHistory = 5
+)
+
+// writeFileAtomic replaces the file at path with content so that readers and
+// crashes only ever leave the old or the new file. The content goes to a
+// temp file of its own, so concurrent writers never share one, and is synced
+// before the rename; the directory is synced after it so the rename survives
+// a crash too.
+func writeFileAtomic(path string, content []byte) error {
+	dir := filepath.Dir(path)
+	file, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tempFile := file.Name()
+	defer os.Remove(tempFile)
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	// CreateTemp makes the file private, but routers run as another user
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to set temp file mode: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+
+	if err := os.Rename(tempFile, path); err != nil {
+		return fmt.Errorf("failed to move temp file: %w", err)
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes a directory's entries to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
+// removeTempFiles removes the temp files of writes interrupted by a crash.
+// Only temp files of writes done under the directory lock, or by this
+// writer, may be removed.
+func removeTempFiles(dataDir string, names ...string) {
+	for _, name := range names {
+		matches, _ := filepath.Glob(filepath.Join(dataDir, name+".*tmp"))
+		for _, match := range matches {
+			if err := os.Remove(match); err == nil {
+				log.Printf("Removed leftover temp file %s", match)
+			}
+		}
+	}
+}
+
+// keepGeneration stores content as the given generation of the discovery
+// file fileName in the history directory and removes all but the newest
+// keep generations
+func keepGeneration(dataDir, fileName string, generation uint64, content []byte, keep int) error {
+	historyDir := filepath.Join(dataDir, HistoryDir)
+	if err := os.MkdirAll(historyDir, 0755); err != nil {
+		return fmt.Errorf("failed to create history directory: %w", err)
+	}
+	path := filepath.Join(historyDir, fmt.Sprintf("%s.%d", fileName, generation))
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("failed to write generation %d: %w", generation, err)
+	}
+
+	entries, err := os.ReadDir(historyDir)
+	if err != nil {
+		return fmt.Errorf("failed to list history directory: %w", err)
+	}
+	var generations []uint64
+	for _, entry := range entries {
+		suffix, found := strings.CutPrefix(entry.Name(), fileName+".")
+		if !found {
+			continue
+		}
+		if kept, err := strconv.ParseUint(suffix, 10, 64); err == nil {
+			generations = append(generations, kept)
+		}
+	}
+	sort.Slice(generations, func(i, j int) bool {
+		return generations[i] > generations[j]
+	})
+	for _, old := range generations[min(keep, len(generations)):] {
+		os.Remove(filepath.Join(historyDir, fmt.Sprintf("%s.%d", fileName, old)))
+	}
+	return nil
+}
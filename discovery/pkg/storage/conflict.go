@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker-router/discovery/pkg/types"
+)
+
+// DefaultConflictWindow is how long a host IP claim for a stack ID is
+// remembered when looking for duplicate stack IDs
+const DefaultConflictWindow = 90 * time.Second
+
+// SetConflictWindow sets how long host IP claims are remembered. A stack ID
+// whose host IP switches back to one it was claimed from within the window
+// is reported as a duplicate.
+func (fs *FileStorage) SetConflictWindow(window time.Duration) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.conflictWindow = window
+}
+
+// SetLocalStackID sets our own stack ID, so that a peer reported under it is
+// marked as a duplicate_stack_id conflict
+func (fs *FileStorage) SetLocalStackID(stackID string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.localStackID = stackID
+}
+
+// recordClaim remembers that stackID was reported from hostIP. A stack ID
+// moving to a new host IP once is a legitimate address change; switching
+// back to an address it recently had means two hosts are announcing it.
+func (fs *FileStorage) recordClaim(stackID, hostIP, previousIP string, now time.Time) {
+	claims, exists := fs.claims[stackID]
+	if !exists {
+		claims = make(map[string]time.Time)
+		fs.claims[stackID] = claims
+	}
+
+	if previousIP != "" && previousIP != hostIP {
+		if claimedAt, ok := claims[hostIP]; ok && now.Sub(claimedAt) <= fs.conflictWindow {
+			fs.flapped[stackID] = now
+		}
+	}
+	claims[hostIP] = now
+}
+
+// forgetClaims drops the conflict state of a removed peer
+func (fs *FileStorage) forgetClaims(stackID string) {
+	delete(fs.claims, stackID)
+	delete(fs.flapped, stackID)
+}
+
+// expireClaims drops host IP claims and flaps older than the conflict window
+func (fs *FileStorage) expireClaims(now time.Time) {
+	for stackID, claims := range fs.claims {
+		for hostIP, claimedAt := range claims {
+			if now.Sub(claimedAt) > fs.conflictWindow {
+				delete(claims, hostIP)
+			}
+		}
+		if len(claims) == 0 {
+			delete(fs.claims, stackID)
+		}
+	}
+	for stackID, flappedAt := range fs.flapped {
+		if now.Sub(flappedAt) > fs.conflictWindow {
+			delete(fs.flapped, stackID)
+		}
+	}
+}
+
+// detectConflicts marks peers whose stack ID is claimed by several hosts or
+// by this host, or whose advertised subnets overlap another peer's, and
+// clears the mark once the conflict is gone. Routers must not program routes
+// for such peers.
+func (fs *FileStorage) detectConflicts() {
+	reasons := make(map[string]string)
+
+	if peer, exists := fs.peers[fs.localStackID]; exists && fs.localStackID != "" {
+		reasons[fs.localStackID] = fmt.Sprintf("duplicate_stack_id: local stack ID announced by host IP %s", peer.HostIP)
+	}
+
+	for stackID := range fs.flapped {
+		if _, exists := reasons[stackID]; exists {
+			continue
+		}
+		if _, exists := fs.peers[stackID]; exists {
+			reasons[stackID] = fmt.Sprintf("stack ID claimed by host IPs %s", strings.Join(fs.claimedIPs(stackID), ", "))
+		}
+	}
+
+	// Compare every pair of peers' subnets
+	stackIDs := make([]string, 0, len(fs.peers))
+	subnets := make(map[string][]*net.IPNet)
+	for stackID, peer := range fs.peers {
+		stackIDs = append(stackIDs, stackID)
+		for _, subnet := range peer.Subnets {
+			if _, ipNet, err := net.ParseCIDR(subnet); err == nil {
+				subnets[stackID] = append(subnets[stackID], ipNet)
+			}
+		}
+	}
+	sort.Strings(stackIDs)
+	for i, a := range stackIDs {
+		for _, b := range stackIDs[i+1:] {
+			if subnetA, subnetB, ok := overlap(subnets[a], subnets[b]); ok {
+				if _, exists := reasons[a]; !exists {
+					reasons[a] = fmt.Sprintf("subnet %s overlaps %s of stack %s", subnetA, subnetB, b)
+				}
+				if _, exists := reasons[b]; !exists {
+					reasons[b] = fmt.Sprintf("subnet %s overlaps %s of stack %s", subnetB, subnetA, a)
+				}
+			}
+		}
+	}
+
+	for stackID, peer := range fs.peers {
+		reason := reasons[stackID]
+		if reason != peer.Conflict {
+			if reason != "" {
+				log.Printf("Conflict for peer %s: %s", stackID, reason)
+			} else {
+				log.Printf("Conflict for peer %s resolved", stackID)
+			}
+			peer.Conflict = reason
+		}
+		applyConflictStatus(peer)
+	}
+}
+
+// claimedIPs returns the host IPs a stack ID was recently claimed from
+func (fs *FileStorage) claimedIPs(stackID string) []string {
+	ips := make([]string, 0, len(fs.claims[stackID]))
+	for hostIP := range fs.claims[stackID] {
+		ips = append(ips, hostIP)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// applyConflictStatus reflects a peer's conflict in its status. Stale and
+// dead peers keep their status, since they are not routed to anyway.
+func applyConflictStatus(peer *types.Peer) {
+	switch {
+	case peer.Conflict != "" && (peer.Status == types.PeerStatusActive || peer.Status == types.PeerStatusSuspect):
+		peer.Status = types.PeerStatusConflict
+	case peer.Conflict == "" && peer.Status == types.PeerStatusConflict:
+		peer.Status = types.PeerStatusActive
+	}
+}
+
+// overlap returns the first pair of overlapping subnets from a and b
+func overlap(a, b []*net.IPNet) (*net.IPNet, *net.IPNet, bool) {
+	for _, x := range a {
+		for _, y := range b {
+			if x.Contains(y.IP) || y.Contains(x.IP) {
+				return x, y, true
+			}
+		}
+	}
+	return nil, nil, false
+}
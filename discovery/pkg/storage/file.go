@@ -1,27 +1,70 @@
 package storage
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/docker-router/discovery/pkg/types"
+	"github.com/docker-router/schema"
 )
 
 const (
 	DefaultDataDir = "/var/lib/docker-router"
-	DiscoveryFile  = "discovery.json"
-	LockFile       = "discovery.lock"
+	DiscoveryFile  = schema.DefaultDiscoveryFile
+	LockFile       = schema.LockFile
+	// RestoredSource is recorded as the source of reloaded peers whose
+	// discovery file entry lists none, as older versions wrote it
+	RestoredSource = "restored"
 )
 
+// AnnouncedTimeoutMultiplier is how many of its advertised announce
+// intervals a peer may stay silent before it is marked stale
+const AnnouncedTimeoutMultiplier = 3
+
+// VNIDiscoveryFile returns the discovery file name used for one VNI when a
+// daemon serves several
+func VNIDiscoveryFile(vni int) string {
+	return fmt.Sprintf("discovery-%d.json", vni)
+}
+
 // FileStorage manages peer data persistence
 type FileStorage struct {
-	dataDir string
-	mutex   sync.RWMutex
-	peers   map[string]*types.Peer
+	dataDir  string
+	fileName string
+	mutex    sync.RWMutex
+	peers    map[string]*types.Peer
+	// sources records when each backend last reported a peer (stack ID -> source -> time)
+	sources map[string]map[string]time.Time
+	// claims records when a stack ID was last reported from each host IP
+	// (stack ID -> host IP -> time), and flapped when its host IP last
+	// switched back to an earlier one; see conflict.go
+	claims         map[string]map[string]time.Time
+	flapped        map[string]time.Time
+	conflictWindow time.Duration
+	// maxPeers caps the number of peers; zero means no limit
+	maxPeers int
+	// writerID identifies this daemon among the writers of a shared data
+	// directory; see merge.go
+	writerID      string
+	writerTimeout time.Duration
+	// writeMutex serializes writes of the discovery file, and guards lastBeat,
+	// the time of our last heartbeat (see heartbeat.go), and generation, the
+	// last generation of the file we saw
+	writeMutex        sync.Mutex
+	heartbeatInterval time.Duration
+	lastBeat          time.Time
+	generation        uint64
+	// history is how many generations of the file are kept; see atomic.go
+	history int
+	// localStackID is our own stack ID; a peer reported under it is another
+	// host using the same ID
+	localStackID string
 }
 
 // NewFileStorage creates a new file storage instance
@@ -29,33 +72,223 @@ func NewFileStorage(dataDir string) *FileStorage {
 	if dataDir == "" {
 		dataDir = DefaultDataDir
 	}
-	
+
 	return &FileStorage{
-		dataDir: dataDir,
-		peers:   make(map[string]*types.Peer),
+		dataDir:  dataDir,
+		fileName: DiscoveryFile,
+		peers:    make(map[string]*types.Peer),
+		sources:  make(map[string]map[string]time.Time),
+		claims:   make(map[string]map[string]time.Time),
+		flapped:  make(map[string]time.Time),
+
+		conflictWindow:    DefaultConflictWindow,
+		writerID:          DefaultWriterID(),
+		writerTimeout:     DefaultWriterTimeout,
+		heartbeatInterval: DefaultHeartbeatInterval,
+		history:           DefaultHistory,
 	}
 }
 
-// Initialize creates the data directory if it doesn't exist
+// SetFileName sets the name of the discovery file inside the data directory
+func (fs *FileStorage) SetFileName(name string) {
+	fs.fileName = name
+}
+
+// DefaultWriterID returns a writer ID unique to this process on this host
+func DefaultWriterID() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// SetWriterID sets the ID this daemon records on the entries it contributes
+// to a discovery file shared with other daemons. It must be stable across
+// restarts for reloaded peers to be recognized as our own.
+func (fs *FileStorage) SetWriterID(id string) {
+	fs.writerID = id
+}
+
+// SetHistory sets how many generations of the discovery file are kept in
+// the history directory; zero keeps none
+func (fs *FileStorage) SetHistory(generations int) {
+	fs.history = generations
+}
+
+// SetMaxPeers caps the number of peers kept; zero means no limit
+func (fs *FileStorage) SetMaxPeers(max int) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.maxPeers = max
+}
+
+// Initialize creates the data directory if it doesn't exist and reloads the
+// peers of an existing discovery file, so a restart does not make routers
+// withdraw routes until the peers announce themselves again
 func (fs *FileStorage) Initialize() error {
-	return os.MkdirAll(fs.dataDir, 0755)
+	if err := os.MkdirAll(fs.dataDir, 0755); err != nil {
+		return err
+	}
+
+	unlock, err := lockExclusive(fs.dataDir)
+	if err != nil {
+		return err
+	}
+	removeTempFiles(fs.dataDir, fs.fileName, HeartbeatFile, StatsFileName(fs.writerID))
+	unlock()
+
+	fs.load()
+	return nil
+}
+
+// Load returns a consistent snapshot of the discovery file, including the
+// peers other daemons sharing the data directory contributed. The file is
+// only rewritten when its content changes, so last_seen times in it may lag.
+func (fs *FileStorage) Load() (*schema.DiscoveryData, error) {
+	return ReadSnapshot(fs.dataDir, fs.fileName)
 }
 
-// AddPeer adds or updates a peer
-func (fs *FileStorage) AddPeer(peer *types.Peer) {
+// load restores our own peers from the previous discovery file; entries
+// only other writers contributed are theirs to maintain. Restored peers keep
+// their sources and are considered seen when we last confirmed the file with
+// a heartbeat, so they age out normally unless they are reported again. An
+// unreadable file is ignored; it is replaced on the next write.
+func (fs *FileStorage) load() {
+	data, err := fs.Load()
+	if err != nil {
+		log.Printf("Warning: not reloading peers: %v", err)
+		return
+	}
+	confirmed := readHeartbeat(fs.dataDir).Writers[fs.writerID]
+	fs.generation = data.Generation
+
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
-	
-	peer.LastSeen = time.Now()
+
+	peers := FromSchema(data.Peers)
+	for i := range peers {
+		peer := &peers[i]
+		if peer.StackID == "" || (len(peer.Writers) > 0 && !contains(peer.Writers, fs.writerID)) {
+			continue
+		}
+		peer.Writers = nil
+		if isLive(peer.Status) && confirmed.After(peer.LastSeen) {
+			peer.LastSeen = confirmed
+		}
+		seen := make(map[string]time.Time)
+		for _, source := range peer.Sources {
+			seen[source] = peer.LastSeen
+		}
+		if len(seen) == 0 && isLive(peer.Status) {
+			seen[RestoredSource] = peer.LastSeen
+			peer.Sources = []string{RestoredSource}
+		}
+		fs.peers[peer.StackID] = peer
+		fs.sources[peer.StackID] = seen
+	}
+	fs.detectConflicts()
+
+	if len(fs.peers) > 0 {
+		log.Printf("Reloaded %d peers from %s", len(fs.peers), filepath.Join(fs.dataDir, fs.fileName))
+	}
+}
+
+// isLive reports whether a peer in the given status was still being reported
+func isLive(status string) bool {
+	return status != types.PeerStatusStale && status != types.PeerStatusDead
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// AddPeer adds or updates a peer reported by the given source backend. A new
+// peer is refused, returning false, when the peer limit is reached.
+func (fs *FileStorage) AddPeer(peer *types.Peer, source string) bool {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if _, exists := fs.peers[peer.StackID]; !exists && fs.maxPeers > 0 && len(fs.peers) >= fs.maxPeers {
+		return false
+	}
+
+	now := time.Now()
+	seen, exists := fs.sources[peer.StackID]
+	if !exists {
+		seen = make(map[string]time.Time)
+		fs.sources[peer.StackID] = seen
+	}
+	seen[source] = now
+
+	var previousIP string
+	if previous, exists := fs.peers[peer.StackID]; exists {
+		previousIP = previous.HostIP
+		peer.Conflict = previous.Conflict
+		// Sources that do not know the announce interval keep the one
+		// the peer advertised
+		if peer.AnnounceInterval == 0 {
+			peer.AnnounceInterval = previous.AnnounceInterval
+		}
+	}
+	fs.recordClaim(peer.StackID, peer.HostIP, previousIP, now)
+
+	peer.LastSeen = now
 	peer.Status = types.PeerStatusActive
+	peer.Sources = sortedSources(seen)
 	fs.peers[peer.StackID] = peer
+	fs.detectConflicts()
+	return true
+}
+
+// RemovePeer withdraws a peer as reported by the given source backend. The
+// peer is deleted once no source reports it any more; the return value tells
+// whether that happened.
+func (fs *FileStorage) RemovePeer(stackID, source string) bool {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	seen, exists := fs.sources[stackID]
+	if !exists {
+		return false
+	}
+	delete(seen, source)
+
+	if len(seen) == 0 {
+		delete(fs.sources, stackID)
+		delete(fs.peers, stackID)
+		fs.forgetClaims(stackID)
+		fs.detectConflicts()
+		return true
+	}
+
+	fs.peers[stackID].Sources = sortedSources(seen)
+	return false
 }
 
-// GetPeers returns all active peers
+// SetPeerStatus changes the status of a known peer without refreshing it.
+// It reports whether the status changed.
+func (fs *FileStorage) SetPeerStatus(stackID, status string) bool {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	peer, exists := fs.peers[stackID]
+	if !exists {
+		return false
+	}
+	previous := peer.Status
+	peer.Status = status
+	applyConflictStatus(peer)
+	return peer.Status != previous
+}
+
+// GetPeers returns all known peers, including stale ones
 func (fs *FileStorage) GetPeers() []*types.Peer {
 	fs.mutex.RLock()
 	defer fs.mutex.RUnlock()
-	
+
 	var peers []*types.Peer
 	for _, peer := range fs.peers {
 		peers = append(peers, peer)
@@ -63,57 +296,150 @@ func (fs *FileStorage) GetPeers() []*types.Peer {
 	return peers
 }
 
-// CleanupStale removes stale peers
-func (fs *FileStorage) CleanupStale(timeout time.Duration) {
+// CleanupStale expires sources that have not reported a peer within its
+// timeout: AnnouncedTimeoutMultiplier times the announce interval the peer
+// advertises, or the given timeout for peers that advertise none. A peer
+// that no source reports any more is marked stale and kept for staleHold
+// before it is removed, so a short outage does not flap routes. Peers
+// already marked dead are not revived as stale.
+func (fs *FileStorage) CleanupStale(timeout, staleHold time.Duration) {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
-	
+
 	now := time.Now()
-	for stackID, peer := range fs.peers {
-		if now.Sub(peer.LastSeen) > timeout {
+	for stackID, seen := range fs.sources {
+		peer := fs.peers[stackID]
+		peerTimeout := timeout
+		if peer.AnnounceInterval > 0 {
+			peerTimeout = AnnouncedTimeoutMultiplier * time.Duration(peer.AnnounceInterval) * time.Second
+		}
+		for source, seenAt := range seen {
+			if now.Sub(seenAt) > peerTimeout {
+				delete(seen, source)
+			}
+		}
+
+		if len(seen) > 0 {
+			peer.LastSeen = latest(seen)
+			peer.Sources = sortedSources(seen)
+			continue
+		}
+
+		if now.Sub(peer.LastSeen) > peerTimeout+staleHold {
+			delete(fs.sources, stackID)
 			delete(fs.peers, stackID)
+			fs.forgetClaims(stackID)
+			continue
+		}
+
+		if peer.Status != types.PeerStatusDead {
+			peer.Status = types.PeerStatusStale
 		}
 	}
+
+	fs.expireClaims(now)
+	fs.detectConflicts()
 }
 
-// WriteDiscoveryFile writes the current peer data to the shared volume
-func (fs *FileStorage) WriteDiscoveryFile() error {
-	fs.mutex.RLock()
-	defer fs.mutex.RUnlock()
-	
+// latest returns the most recent report time of a peer's sources
+func latest(seen map[string]time.Time) time.Time {
+	var last time.Time
+	for _, seenAt := range seen {
+		if seenAt.After(last) {
+			last = seenAt
+		}
+	}
+	return last
+}
+
+// sortedSources returns the source names in a stable order
+func sortedSources(seen map[string]time.Time) []string {
+	sources := make([]string, 0, len(seen))
+	for source := range seen {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// WriteDiscoveryFile writes the current peer data to the shared volume.
+// Under the exclusive lock of the data directory it reads the file, merges
+// our peers into what other daemons sharing the directory wrote, and
+// replaces it, so concurrent writers never drop each other's peers. The file
+// is left alone unless peers or their attributes changed, so routers only
+// reload on real changes; liveness goes to the heartbeat file instead. It
+// reports whether the file was written.
+func (fs *FileStorage) WriteDiscoveryFile() (bool, error) {
+	fs.writeMutex.Lock()
+	defer fs.writeMutex.Unlock()
+
 	// Convert map to slice
+	fs.mutex.RLock()
 	var peers []types.Peer
 	for _, peer := range fs.peers {
 		peers = append(peers, *peer)
 	}
-	
-	data := types.DiscoveryData{
-		Version:    1,
-		LastUpdate: time.Now(),
-		Peers:      peers,
+	fs.mutex.RUnlock()
+
+	unlock, err := lockExclusive(fs.dataDir)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	now := time.Now()
+	heartbeat := readHeartbeat(fs.dataDir)
+	if now.Sub(fs.lastBeat) >= fs.heartbeatInterval {
+		if err := beat(fs.dataDir, heartbeat, fs.writerID, fs.writerTimeout, now); err != nil {
+			return false, err
+		}
+		fs.lastBeat = now
+	}
+
+	// A file written by a newer version is left alone rather than
+	// downgraded; anything else unreadable is replaced
+	discoveryFile := filepath.Join(fs.dataDir, fs.fileName)
+	existing, err := readDiscoveryFile(discoveryFile)
+	var versionErr *schema.VersionError
+	if errors.As(err, &versionErr) {
+		return false, err
 	}
-	
-	// Write to temporary file first
-	tempFile := filepath.Join(fs.dataDir, DiscoveryFile+".tmp")
-	file, err := os.Create(tempFile)
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
-	}
-	defer file.Close()
-	
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(data); err != nil {
-		return fmt.Errorf("failed to encode data: %w", err)
-	}
-	
-	// Atomic move
-	discoveryFile := filepath.Join(fs.dataDir, DiscoveryFile)
-	if err := os.Rename(tempFile, discoveryFile); err != nil {
-		return fmt.Errorf("failed to move temp file: %w", err)
-	}
-	
-	return nil
+		log.Printf("Warning: replacing unreadable discovery file: %v", err)
+		existing = &schema.DiscoveryData{}
+	}
+	existingPeers := FromSchema(existing.Peers)
+	merged := mergePeers(existingPeers, peers, fs.writerID, heartbeat.Writers, fs.writerTimeout, now)
+
+	// Files of an older version are rewritten in the current one even when
+	// their content is the same
+	if _, err := os.Stat(discoveryFile); err == nil && existing.Version == schema.CurrentVersion && contentDigest(merged) == contentDigest(existingPeers) {
+		return false, nil
+	}
+
+	// Generations only grow, even across an unreadable file
+	data := schema.DiscoveryData{
+		Generation: max(existing.Generation, fs.generation) + 1,
+		LastUpdate: now,
+		Peers:      toSchema(merged),
+	}
+	content, err := schema.Encode(&data)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode data: %w", err)
+	}
+
+	if err := writeFileAtomic(discoveryFile, content); err != nil {
+		return false, err
+	}
+	fs.generation = data.Generation
+
+	if fs.history > 0 {
+		if err := keepGeneration(fs.dataDir, fs.fileName, data.Generation, content, fs.history); err != nil {
+			log.Printf("Warning: not keeping generation %d of %s: %v", data.Generation, fs.fileName, err)
+		}
+	}
+
+	return true, nil
 }
 
 // GetPeerCount returns the number of active peers
@@ -121,4 +447,4 @@ func (fs *FileStorage) GetPeerCount() int {
 	fs.mutex.RLock()
 	defer fs.mutex.RUnlock()
 	return len(fs.peers)
-}
\ No newline at end of file
+}
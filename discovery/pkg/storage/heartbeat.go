@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker-router/discovery/pkg/types"
+)
+
+// HeartbeatFile records the liveness of the daemons writing a data directory
+const HeartbeatFile = "heartbeat.json"
+
+// DefaultHeartbeatInterval is how often a daemon refreshes its heartbeat. It
+// must stay well below DefaultWriterTimeout.
+const DefaultHeartbeatInterval = 30 * time.Second
+
+// readHeartbeat reads the heartbeat file; the caller holds the lock. A
+// missing or unreadable file yields no writers, which only delays merging
+// until they beat again.
+func readHeartbeat(dataDir string) *types.HeartbeatData {
+	data := &types.HeartbeatData{}
+	content, err := os.ReadFile(filepath.Join(dataDir, HeartbeatFile))
+	if err == nil {
+		err = json.Unmarshal(content, data)
+	}
+	if data.Writers == nil || err != nil {
+		data.Writers = make(map[string]time.Time)
+	}
+	return data
+}
+
+// beat records writerID as alive at now, forgets writers that timed out and
+// replaces the heartbeat file; the caller holds the lock
+func beat(dataDir string, data *types.HeartbeatData, writerID string, writerTimeout time.Duration, now time.Time) error {
+	for writer, lastBeat := range data.Writers {
+		if now.Sub(lastBeat) > writerTimeout {
+			delete(data.Writers, writer)
+		}
+	}
+	data.Writers[writerID] = now
+	data.LastUpdate = now
+
+	content, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode heartbeat: %w", err)
+	}
+
+	return writeFileAtomic(filepath.Join(dataDir, HeartbeatFile), append(content, '\n'))
+}
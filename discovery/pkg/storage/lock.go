@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/docker-router/schema"
+	"golang.org/x/sys/unix"
+)
+
+// lockExclusive takes the exclusive lock of the data directory, held by a
+// writer for its whole read-merge-write cycle. It returns the unlock function.
+func lockExclusive(dataDir string) (func(), error) {
+	file, err := os.OpenFile(filepath.Join(dataDir, LockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	return flock(file, unix.LOCK_EX)
+}
+
+// lockShared takes the shared lock of the data directory for reading. A
+// directory without a lock file, such as a read-only mount of a single
+// file, is read without locking.
+func lockShared(dataDir string) (func(), error) {
+	file, err := os.Open(filepath.Join(dataDir, LockFile))
+	if os.IsNotExist(err) {
+		return func() {}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	return flock(file, unix.LOCK_SH)
+}
+
+func flock(file *os.File, how int) (func(), error) {
+	if err := unix.Flock(int(file.Fd()), how); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", file.Name(), err)
+	}
+	return func() {
+		unix.Flock(int(file.Fd()), unix.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// ReadSnapshot reads a discovery file under the shared lock of its
+// directory, so it never observes a writer between reading and replacing
+// the file. Files of older schema versions are migrated; a missing file
+// yields empty data.
+func ReadSnapshot(dataDir, fileName string) (*schema.DiscoveryData, error) {
+	unlock, err := lockShared(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return readDiscoveryFile(filepath.Join(dataDir, fileName))
+}
+
+// readDiscoveryFile reads and decodes a discovery file; the caller holds
+// the lock
+func readDiscoveryFile(path string) (*schema.DiscoveryData, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &schema.DiscoveryData{Version: schema.CurrentVersion}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	data, err := schema.Decode(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return data, nil
+}
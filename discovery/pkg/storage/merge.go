@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/docker-router/discovery/pkg/types"
+)
+
+// DefaultWriterTimeout is how long the peers contributed by another discovery
+// daemon sharing the data directory are kept after its last heartbeat.
+// Daemons beat every DefaultHeartbeatInterval, so only a daemon that is gone
+// stays silent this long.
+const DefaultWriterTimeout = 2 * time.Minute
+
+// mergePeers merges our peers into the peers found on disk, sorted by stack
+// ID. Entries other writers contributed are kept while their heartbeat in
+// writers is recent; our own previous contributions are replaced by own. A
+// peer known to several writers is written once, from the freshest report,
+// listing every writer and source.
+func mergePeers(existing, own []types.Peer, writerID string, writers map[string]time.Time, writerTimeout time.Duration, now time.Time) []types.Peer {
+	merged := make(map[string]types.Peer)
+	for _, peer := range existing {
+		var alive []string
+		for _, writer := range peer.Writers {
+			lastBeat, exists := writers[writer]
+			if exists && writer != writerID && now.Sub(lastBeat) <= writerTimeout {
+				alive = append(alive, writer)
+			}
+		}
+		if len(alive) == 0 {
+			continue
+		}
+		peer.Writers = alive
+		merged[peer.StackID] = peer
+	}
+
+	for _, peer := range own {
+		peer.Writers = []string{writerID}
+		if other, exists := merged[peer.StackID]; exists {
+			base := peer
+			if other.LastSeen.After(peer.LastSeen) {
+				base = other
+			}
+			base.Writers = union(other.Writers, []string{writerID})
+			base.Sources = union(other.Sources, peer.Sources)
+			peer = base
+		}
+		merged[peer.StackID] = peer
+	}
+
+	peers := make([]types.Peer, 0, len(merged))
+	for _, peer := range merged {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].StackID < peers[j].StackID
+	})
+	return peers
+}
+
+// contentDigest hashes what routers act on: the peers and their attributes,
+// but not the times they were last seen
+func contentDigest(peers []types.Peer) [sha256.Size]byte {
+	view := make([]types.Peer, len(peers))
+	for i, peer := range peers {
+		peer.LastSeen = time.Time{}
+		view[i] = peer
+	}
+	encoded, _ := json.Marshal(view)
+	return sha256.Sum256(encoded)
+}
+
+// union returns the sorted union of two string lists
+func union(a, b []string) []string {
+	set := make(map[string]bool, len(a)+len(b))
+	for _, value := range a {
+		set[value] = true
+	}
+	for _, value := range b {
+		set[value] = true
+	}
+
+	values := make([]string, 0, len(set))
+	for value := range set {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"github.com/docker-router/discovery/pkg/types"
+	"github.com/docker-router/schema"
+)
+
+// toSchema converts peers to their discovery file entries
+func toSchema(peers []types.Peer) []schema.Peer {
+	entries := make([]schema.Peer, 0, len(peers))
+	for _, peer := range peers {
+		entries = append(entries, schema.Peer{
+			StackID:       peer.StackID,
+			VNI:           peer.VNI,
+			HostIP:        peer.HostIP,
+			VXLANEndpoint: peer.VXLANEndpoint,
+			Addresses:     peer.Addresses,
+			VXLANIP:       peer.VXLANIP,
+			Subnets:       peer.Subnets,
+			Status: schema.Status{
+				State:    schema.State(peer.Status),
+				LastSeen: peer.LastSeen,
+				Reason:   peer.Conflict,
+			},
+			Source: schema.Source{
+				Backends:    peer.Sources,
+				Writers:     peer.Writers,
+				ReflexiveIP: peer.ReflexiveIP,
+			},
+			Attributes: schema.Attributes{
+				Labels:           peer.Labels,
+				Features:         peer.Features,
+				AnnounceInterval: peer.AnnounceInterval,
+			},
+		})
+	}
+	return entries
+}
+
+// FromSchema converts discovery file entries back to peers. It is exported
+// for the static backend, whose peers file uses the discovery file format.
+func FromSchema(entries []schema.Peer) []types.Peer {
+	peers := make([]types.Peer, 0, len(entries))
+	for _, entry := range entries {
+		peers = append(peers, types.Peer{
+			StackID:          entry.StackID,
+			HostIP:           entry.HostIP,
+			VXLANEndpoint:    entry.VXLANEndpoint,
+			VNI:              entry.VNI,
+			LastSeen:         entry.Status.LastSeen,
+			Status:           string(entry.Status.State),
+			ReflexiveIP:      entry.Source.ReflexiveIP,
+			Sources:          entry.Source.Backends,
+			Addresses:        entry.Addresses,
+			VXLANIP:          entry.VXLANIP,
+			Subnets:          entry.Subnets,
+			Conflict:         entry.Status.Reason,
+			Labels:           entry.Attributes.Labels,
+			Features:         entry.Attributes.Features,
+			AnnounceInterval: entry.Attributes.AnnounceInterval,
+			Writers:          entry.Source.Writers,
+		})
+	}
+	return peers
+}
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/docker-router/discovery/pkg/types"
+)
+
+// StatsFileName returns the name of a writer's stats file. Every daemon
+// sharing a data directory writes its own.
+func StatsFileName(writerID string) string {
+	return fmt.Sprintf("stats-%s.json", writerID)
+}
+
+// WriteStatsFile writes the counters to the stats file at path, replacing it
+// atomically like the discovery file
+func WriteStatsFile(path string, counters map[string]uint64) error {
+	data, err := json.MarshalIndent(types.StatsData{
+		LastUpdate: time.Now(),
+		Counters:   counters,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode stats: %w", err)
+	}
+
+	return writeFileAtomic(path, append(data, '\n'))
+}
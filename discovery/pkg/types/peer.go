@@ -2,23 +2,56 @@ package types
 
 import (
 	"time"
+
+	"github.com/docker-router/schema"
 )
 
 // Peer represents a discovered stack peer
 type Peer struct {
-	StackID      string    `json:"stack_id"`
-	HostIP       string    `json:"host_ip"`
-	VXLANEndpoint string   `json:"vxlan_endpoint"`
-	VNI          int       `json:"vni"`
-	LastSeen     time.Time `json:"last_seen"`
-	Status       string    `json:"status"`
+	StackID       string    `json:"stack_id"`
+	HostIP        string    `json:"host_ip"`
+	VXLANEndpoint string    `json:"vxlan_endpoint"`
+	VNI           int       `json:"vni"`
+	LastSeen      time.Time `json:"last_seen"`
+	Status        string    `json:"status"`
+	// ReflexiveIP is the source address the peer's announcements were observed
+	// from, recorded when source verification runs in NAT mode
+	ReflexiveIP string `json:"reflexive_ip,omitempty"`
+	// Sources lists the discovery backends currently reporting the peer
+	Sources []string `json:"sources,omitempty"`
+	// Addresses lists every underlay address of a dual-stack peer, HostIP first
+	Addresses []string `json:"addresses,omitempty"`
+	// VXLANIP is the peer router's overlay address, the next hop for Subnets
+	VXLANIP string `json:"vxlan_ip,omitempty"`
+	// Subnets are the container subnets the peer advertises
+	Subnets []string `json:"subnets,omitempty"`
+	// Conflict describes why the peer is in the conflict status
+	Conflict string `json:"conflict,omitempty"`
+	// Labels are free-form key/value pairs the peer advertises
+	Labels map[string]string `json:"labels,omitempty"`
+	// Features lists the optional protocol features the peer supports
+	Features []string `json:"features,omitempty"`
+	// AnnounceInterval is the peer's steady-state announce interval in
+	// seconds; its timeout is derived from it
+	AnnounceInterval int `json:"announce_interval,omitempty"`
+	// Writers lists the discovery daemons sharing the data directory that
+	// contributed this entry
+	Writers []string `json:"writers,omitempty"`
+}
+
+// HeartbeatData is the structure of the heartbeat file, which records when
+// each discovery daemon writing the data directory was last alive. It
+// changes regularly so the discovery files need not.
+type HeartbeatData struct {
+	LastUpdate time.Time            `json:"last_update"`
+	Writers    map[string]time.Time `json:"writers"`
 }
 
-// DiscoveryData is the structure written to the shared volume
-type DiscoveryData struct {
-	Version    int     `json:"version"`
-	LastUpdate time.Time `json:"last_update"`
-	Peers      []Peer  `json:"peers"`
+// StatsData is the structure of the stats file, which exposes the daemon's
+// counters while it runs
+type StatsData struct {
+	LastUpdate time.Time         `json:"last_update"`
+	Counters   map[string]uint64 `json:"counters"`
 }
 
 // MulticastMessage is the structure for multicast discovery messages
@@ -26,9 +59,58 @@ type MulticastMessage struct {
 	Type      string `json:"type"`
 	Version   int    `json:"version"`
 	StackID   string `json:"stack_id"`
+	Domain    string `json:"domain,omitempty"`
 	HostIP    string `json:"host_ip"`
 	VNI       int    `json:"vni"`
 	Timestamp int64  `json:"timestamp"`
+	Seq       uint64 `json:"seq,omitempty"`
+	// Features is the sender's wire.Features bit set; peers predating it
+	// send none
+	Features uint64 `json:"features,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	// VNIs lists every overlay the sender serves when it serves more than one
+	VNIs []int `json:"vnis,omitempty"`
+	// Addresses lists every underlay address the sender announces when it
+	// runs dual-stack, HostIP first
+	Addresses []string `json:"addresses,omitempty"`
+	// VXLANIP and Subnets advertise the sender's overlay address and the
+	// container subnets reachable through it, so routers need no static
+	// stack mappings
+	VXLANIP string   `json:"vxlan_ip,omitempty"`
+	Subnets []string `json:"subnets,omitempty"`
+	// Labels are free-form key/value pairs describing the sender
+	Labels map[string]string `json:"labels,omitempty"`
+	// AnnounceInterval is the sender's steady-state announce interval in
+	// seconds, from which receivers derive its timeout
+	AnnounceInterval int `json:"announce_interval,omitempty"`
+	// Peers lists the peers known to the sender; unicast discovery uses it to
+	// learn further peers transitively from responses
+	Peers []PeerRef `json:"peers,omitempty"`
+	// ReplyPort is the port of the sender's own unicast socket. The
+	// discovery port is shared by every stack on a host, so responses and
+	// gossip probes are sent here instead.
+	ReplyPort int `json:"reply_port,omitempty"`
+	// Incarnation, ProbeID, Target, TargetAddr and Updates carry the gossip
+	// membership protocol
+	Incarnation uint64         `json:"incarnation,omitempty"`
+	ProbeID     uint64         `json:"probe_id,omitempty"`
+	Target      string         `json:"target,omitempty"`
+	TargetAddr  string         `json:"target_addr,omitempty"`
+	Updates     []MemberUpdate `json:"updates,omitempty"`
+}
+
+// MemberUpdate is a gossip membership delta piggybacked on protocol messages
+type MemberUpdate struct {
+	StackID     string `json:"stack_id"`
+	State       string `json:"state"`
+	Incarnation uint64 `json:"incarnation"`
+}
+
+// PeerRef is a reference to a peer's discovery endpoint
+type PeerRef struct {
+	StackID string `json:"stack_id"`
+	HostIP  string `json:"host_ip"`
+	Port    int    `json:"port"`
 }
 
 // Message types
@@ -36,10 +118,19 @@ const (
 	MessageTypeAnnounce = "ANNOUNCE"
 	MessageTypeQuery    = "QUERY"
 	MessageTypeResponse = "RESPONSE"
+	MessageTypeLeave    = "LEAVE"
+	MessageTypePing     = "PING"
+	MessageTypePingReq  = "PING_REQ"
+	MessageTypeAck      = "ACK"
 )
 
-// Peer status
+// Peer status, as the states of the discovery file schema
 const (
-	PeerStatusActive = "active"
-	PeerStatusStale  = "stale"
-)
\ No newline at end of file
+	PeerStatusActive  = string(schema.StateActive)
+	PeerStatusStale   = string(schema.StateStale)
+	PeerStatusSuspect = string(schema.StateSuspect)
+	PeerStatusDead    = string(schema.StateDead)
+	// PeerStatusConflict marks a peer whose stack ID or subnets clash with
+	// another peer's; Peer.Conflict says why
+	PeerStatusConflict = string(schema.StateConflict)
+)
@@ -0,0 +1,496 @@
+package unicast
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker-router/discovery/pkg/backend"
+	"github.com/docker-router/discovery/pkg/protocol"
+	"github.com/docker-router/discovery/pkg/ratelimit"
+	"github.com/docker-router/discovery/pkg/types"
+)
+
+const (
+	DefaultPort             = protocol.DefaultDiscoveryPort
+	DefaultAnnounceInterval = protocol.DefaultAnnounceInterval
+	DefaultPeerTimeout      = 90 * time.Second
+	// MaxMessageSize is the largest datagram sent; larger messages are
+	// fragmented
+	MaxMessageSize = 8192
+	// MaxPeerRefs caps the number of peers listed in a single response
+	MaxPeerRefs = 64
+	// MaxEndpoints caps the number of endpoints kept; references to further
+	// peers are ignored until others expire
+	MaxEndpoints = 1024
+	// FirstContactRate and FirstContactBurst limit how fast announcements
+	// are sent to newly learned endpoints, so forged peer lists cannot turn
+	// the daemon into a traffic reflector
+	FirstContactRate  = 5
+	FirstContactBurst = MaxPeerRefs
+	// SourceName is recorded as the source of peers found by unicast
+	SourceName = "unicast"
+)
+
+// endpoint is the discovery address of a remote peer
+type endpoint struct {
+	addr *net.UDPAddr
+	// learned is when the endpoint was last referenced by another peer
+	learned time.Time
+	// heard is when we last received a message directly from the endpoint
+	heard time.Time
+}
+
+// Discovery handles unicast peer discovery for networks that drop multicast.
+// It announces to a fixed list of seed addresses, and learns further peers
+// transitively from the peer lists carried in their responses. It implements
+// backend.Backend.
+type Discovery struct {
+	*protocol.Session
+
+	seeds            []string
+	port             int
+	announceInterval time.Duration
+	peerTimeout      time.Duration
+	events           chan backend.PeerEvent
+
+	conn *net.UDPConn
+
+	mutex     sync.Mutex
+	endpoints map[string]*endpoint // stack ID -> endpoint
+	// firstContact rate limits announcements to learned endpoints
+	firstContact *ratelimit.Limiter
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newSession creates a protocol session that fragments messages above
+// MaxMessageSize
+func newSession(stackID string, vni int) *protocol.Session {
+	session := protocol.NewSession(stackID, vni)
+	session.SetMaxMessageSize(MaxMessageSize)
+	return session
+}
+
+// NewDiscovery creates a new unicast discovery instance
+func NewDiscovery(stackID string, vni int, seeds []string) *Discovery {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Discovery{
+		Session:          newSession(stackID, vni),
+		seeds:            seeds,
+		port:             DefaultPort,
+		announceInterval: DefaultAnnounceInterval,
+		peerTimeout:      DefaultPeerTimeout,
+		events:           make(chan backend.PeerEvent, backend.EventBufferSize),
+		endpoints:        make(map[string]*endpoint),
+		firstContact:     ratelimit.NewLimiter(FirstContactRate, FirstContactBurst),
+		ctx:              ctx,
+		cancel:           cancel,
+	}
+}
+
+// ParseSeeds parses a comma-separated list of host[:port] seed addresses,
+// filling in defaultPort where no port is given
+func ParseSeeds(list string, defaultPort int) []string {
+	var seeds []string
+	for _, seed := range strings.Split(list, ",") {
+		seed = strings.TrimSpace(seed)
+		if seed == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(seed); err != nil {
+			seed = net.JoinHostPort(strings.Trim(seed, "[]"), strconv.Itoa(defaultPort))
+		}
+		seeds = append(seeds, seed)
+	}
+	return seeds
+}
+
+// SetPort sets the discovery port
+func (d *Discovery) SetPort(port int) {
+	d.port = port
+}
+
+// SetAnnounceInterval sets the steady-state announce interval
+func (d *Discovery) SetAnnounceInterval(interval time.Duration) {
+	d.announceInterval = interval
+	d.Session.SetAnnounceInterval(interval)
+}
+
+// SetPeerTimeout sets how long learned endpoints are kept without contact
+func (d *Discovery) SetPeerTimeout(timeout time.Duration) {
+	d.peerTimeout = timeout
+}
+
+// Name returns the backend name
+func (d *Discovery) Name() string {
+	return SourceName
+}
+
+// Events returns the stream of peers discovered over unicast
+func (d *Discovery) Events() <-chan backend.PeerEvent {
+	return d.events
+}
+
+// Start begins the discovery process
+func (d *Discovery) Start() error {
+	if len(d.seeds) == 0 {
+		return fmt.Errorf("unicast discovery requires at least one seed peer")
+	}
+
+	// Detect host IP
+	if err := d.DetectHostAddresses(); err != nil {
+		return fmt.Errorf("failed to detect host IP: %w", err)
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: d.port})
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %w", d.port, err)
+	}
+	d.conn = conn
+
+	log.Printf("Unicast discovery started for stack %s on %v port %d with seeds %v (authentication: %v)",
+		d.StackID(), d.Addresses(), d.port, d.seeds, d.AuthEnabled())
+
+	// Start goroutines
+	d.wg.Add(3)
+	go d.announceLoop()
+	go d.listenLoop()
+	go d.cleanupLoop()
+
+	return nil
+}
+
+// Stop stops the discovery process
+func (d *Discovery) Stop() error {
+	d.sendLeave()
+	d.cancel()
+
+	if d.conn != nil {
+		d.conn.Close()
+	}
+
+	d.wg.Wait()
+	log.Printf("Unicast discovery stopped for stack %s", d.StackID())
+	return nil
+}
+
+// announceLoop announces this peer to the seeds and every learned peer on the
+// session's adaptive, jittered schedule
+func (d *Discovery) announceLoop() {
+	defer d.wg.Done()
+
+	schedule := d.AnnounceSchedule()
+
+	// Send initial announcement
+	d.announceAll()
+
+	for {
+		timer := time.NewTimer(schedule.Next())
+		select {
+		case <-d.ctx.Done():
+			timer.Stop()
+			return
+		case <-schedule.Resets():
+			// Start over at the fast interval after a topology change
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+		d.announceAll()
+	}
+}
+
+// listenLoop listens for incoming unicast messages
+func (d *Discovery) listenLoop() {
+	defer d.wg.Done()
+
+	buffer := make([]byte, protocol.ReadBufferSize)
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		default:
+			d.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+			n, addr, err := d.conn.ReadFromUDP(buffer)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					continue
+				}
+				log.Printf("Error reading UDP message: %v", err)
+				continue
+			}
+
+			d.handleMessage(buffer[:n], addr)
+		}
+	}
+}
+
+// cleanupLoop periodically expires replay state and forgotten endpoints, and
+// re-checks the host addresses, announcing at once when they change
+func (d *Discovery) cleanupLoop() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.peerTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			d.Expire()
+			d.expireEndpoints()
+			if d.RecheckHostAddresses() {
+				d.announceAll()
+			}
+		}
+	}
+}
+
+// expireEndpoints forgets endpoints that have been neither heard from nor
+// referenced by another peer within the peer timeout
+func (d *Discovery) expireEndpoints() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	cutoff := time.Now().Add(-d.peerTimeout)
+	for stackID, ep := range d.endpoints {
+		if ep.heard.Before(cutoff) && ep.learned.Before(cutoff) {
+			delete(d.endpoints, stackID)
+		}
+	}
+}
+
+// announceAll sends an announcement to every seed and learned endpoint
+func (d *Discovery) announceAll() {
+	for _, addr := range d.targets() {
+		d.sendAnnouncement(addr)
+	}
+}
+
+// sendLeave tells every seed and learned endpoint we are going away
+func (d *Discovery) sendLeave() {
+	if d.conn == nil {
+		return
+	}
+
+	targets := d.targets()
+	for i := 0; i < protocol.LeaveRepeats; i++ {
+		if i > 0 {
+			time.Sleep(protocol.LeaveInterval)
+		}
+		for _, addr := range targets {
+			message := d.NewMessage(types.MessageTypeLeave)
+			if err := d.sendMessage(message, addr); err != nil {
+				log.Printf("Error sending leave to %s: %v", addr, err)
+			}
+		}
+	}
+	log.Printf("Sent leave for stack %s to %d peers", d.StackID(), len(targets))
+}
+
+// seedAddrs resolves the seed addresses, keyed by their string form
+func (d *Discovery) seedAddrs() map[string]*net.UDPAddr {
+	seeds := make(map[string]*net.UDPAddr)
+	for _, seed := range d.seeds {
+		addr, err := net.ResolveUDPAddr("udp", seed)
+		if err != nil {
+			log.Printf("Error resolving seed %s: %v", seed, err)
+			continue
+		}
+		seeds[addr.String()] = addr
+	}
+	return seeds
+}
+
+// targets returns the addresses of every seed and learned endpoint
+func (d *Discovery) targets() map[string]*net.UDPAddr {
+	targets := d.seedAddrs()
+
+	d.mutex.Lock()
+	for _, ep := range d.endpoints {
+		targets[ep.addr.String()] = ep.addr
+	}
+	d.mutex.Unlock()
+
+	return targets
+}
+
+// sendAnnouncement sends an announcement message to a single address
+func (d *Discovery) sendAnnouncement(addr *net.UDPAddr) {
+	message := d.NewMessage(types.MessageTypeAnnounce)
+	if err := d.sendMessage(message, addr); err != nil {
+		log.Printf("Error sending announcement to %s: %v", addr, err)
+	}
+}
+
+// sendMessage encodes and sends a message
+func (d *Discovery) sendMessage(message *types.MulticastMessage, addr *net.UDPAddr) error {
+	datagrams, err := d.Encode(message)
+	if err != nil {
+		return err
+	}
+
+	for _, data := range datagrams {
+		if _, err := d.conn.WriteToUDP(data, addr); err != nil {
+			return fmt.Errorf("failed to send %s message: %w", message.Type, err)
+		}
+	}
+	return nil
+}
+
+// handleMessage processes received unicast messages
+func (d *Discovery) handleMessage(data []byte, addr *net.UDPAddr) {
+	message, ok := d.Decode(data, addr)
+	if !ok {
+		return
+	}
+
+	switch message.Type {
+	case types.MessageTypeAnnounce:
+		if d.recordPeer(message, addr) {
+			d.sendResponse(addr)
+		}
+	case types.MessageTypeQuery:
+		d.sendResponse(addr)
+	case types.MessageTypeResponse:
+		if d.recordPeer(message, addr) && d.trustsPeerList(addr) {
+			d.learnPeers(message.Peers)
+		}
+	case types.MessageTypeLeave:
+		d.handleLeave(message, addr)
+	}
+}
+
+// handleLeave withdraws a peer that announced it is shutting down
+func (d *Discovery) handleLeave(message *types.MulticastMessage, addr *net.UDPAddr) {
+	peer, ok := d.PeerFromMessage(message, addr)
+	if !ok {
+		return
+	}
+
+	d.mutex.Lock()
+	delete(d.endpoints, peer.StackID)
+	d.mutex.Unlock()
+
+	log.Printf("Peer left: %s (%s)", peer.StackID, peer.HostIP)
+	backend.Emit(d.ctx, d.events, backend.PeerEvent{Type: backend.EventPeerDown, Peer: *peer, VNIs: d.SharedVNIs(message)})
+}
+
+// recordPeer reports the sender as a peer and remembers its endpoint
+func (d *Discovery) recordPeer(message *types.MulticastMessage, addr *net.UDPAddr) bool {
+	peer, ok := d.PeerFromMessage(message, addr)
+	if !ok {
+		return false
+	}
+
+	d.mutex.Lock()
+	ep, exists := d.endpoints[peer.StackID]
+	if !exists {
+		ep = &endpoint{}
+		d.endpoints[peer.StackID] = ep
+	}
+	ep.addr = addr
+	ep.heard = time.Now()
+	d.mutex.Unlock()
+
+	log.Printf("Discovered peer: %s (%s) via %s", peer.StackID, peer.HostIP, addr)
+	backend.Emit(d.ctx, d.events, backend.PeerEvent{Type: backend.EventPeerUp, Peer: *peer, VNIs: d.SharedVNIs(message)})
+	return true
+}
+
+// trustsPeerList reports whether the peers listed by the sender may be
+// learned: with authentication every accepted message comes from a holder of
+// the secret, and without it only the configured seeds are trusted
+func (d *Discovery) trustsPeerList(addr *net.UDPAddr) bool {
+	if d.AuthEnabled() {
+		return true
+	}
+	_, seed := d.seedAddrs()[addr.String()]
+	return seed
+}
+
+// learnPeers adds endpoints referenced by another peer and announces to the
+// ones we did not know yet. Second-hand references are only used as targets;
+// a peer enters the discovery file once it answers us directly. At most
+// MaxEndpoints are kept and first contact is rate limited; references
+// skipped now are learned from a later response.
+func (d *Discovery) learnPeers(refs []types.PeerRef) {
+	var newTargets []*net.UDPAddr
+
+	d.mutex.Lock()
+	now := time.Now()
+	for _, ref := range refs {
+		if ref.StackID == d.StackID() || ref.Port == 0 {
+			continue
+		}
+		ip := net.ParseIP(ref.HostIP)
+		if ip == nil {
+			continue
+		}
+
+		if ep, exists := d.endpoints[ref.StackID]; exists {
+			ep.learned = now
+			continue
+		}
+		if len(d.endpoints) >= MaxEndpoints {
+			continue
+		}
+		if allowed, _ := d.firstContact.Allow(""); !allowed {
+			continue
+		}
+
+		addr := &net.UDPAddr{IP: ip, Port: ref.Port}
+		d.endpoints[ref.StackID] = &endpoint{addr: addr, learned: now}
+		newTargets = append(newTargets, addr)
+	}
+	d.mutex.Unlock()
+
+	for _, addr := range newTargets {
+		log.Printf("Learned peer endpoint %s, announcing", addr)
+		d.sendAnnouncement(addr)
+	}
+}
+
+// sendResponse answers a peer with our information and the peers we can reach
+func (d *Discovery) sendResponse(addr *net.UDPAddr) {
+	response := d.NewMessage(types.MessageTypeResponse)
+	response.Peers = d.peerRefs()
+
+	if err := d.sendMessage(response, addr); err != nil {
+		log.Printf("Error sending response to %s: %v", addr, err)
+	}
+}
+
+// peerRefs lists the endpoints we have heard from directly within the peer timeout
+func (d *Discovery) peerRefs() []types.PeerRef {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	cutoff := time.Now().Add(-d.peerTimeout)
+	var refs []types.PeerRef
+	for stackID, ep := range d.endpoints {
+		if ep.heard.Before(cutoff) {
+			continue
+		}
+		refs = append(refs, types.PeerRef{
+			StackID: stackID,
+			HostIP:  ep.addr.IP.String(),
+			Port:    ep.addr.Port,
+		})
+		if len(refs) == MaxPeerRefs {
+			break
+		}
+	}
+	return refs
+}
@@ -0,0 +1,499 @@
+package wire
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/docker-router/discovery/pkg/types"
+)
+
+const (
+	// VersionJSON is the version of the original JSON message format
+	VersionJSON = 1
+	// VersionBinary is the version of the binary message format, and the
+	// newest version this implementation decodes
+	VersionBinary = 2
+)
+
+// magic starts every binary message. JSON messages start with '{', so the
+// two formats can be told apart from the first byte.
+var magic = [2]byte{0xd7, 'R'}
+
+// Binary messages are the magic, a version byte and the sender's features as
+// a uvarint, followed by fields. Each field is a uvarint tag, a uvarint
+// length and the value; list fields repeat their tag. Decoders skip tags
+// they do not know, so later versions can add fields without breaking older
+// peers. Tag 9 is retired: it carried the signature, which now travels in
+// the signed envelope.
+const (
+	tagType        = 1
+	tagStackID     = 2
+	tagDomain      = 3
+	tagHostIP      = 4
+	tagVNI         = 5
+	tagTimestamp   = 6
+	tagSeq         = 7
+	tagNonce       = 8
+	tagVNIs        = 10
+	tagAddresses   = 11
+	tagVXLANIP     = 12
+	tagSubnets     = 13
+	tagPeers       = 14
+	tagIncarnation = 15
+	tagProbeID     = 16
+	tagTarget      = 17
+	tagTargetAddr  = 18
+	tagUpdates     = 19
+	tagLabels      = 20
+	tagInterval    = 21
+	tagReplyPort   = 22
+)
+
+// Nested field tags of peer references, member updates and labels
+const (
+	tagRefStackID = 1
+	tagRefHostIP  = 2
+	tagRefPort    = 3
+
+	tagUpdateStackID     = 1
+	tagUpdateState       = 2
+	tagUpdateIncarnation = 3
+
+	tagLabelKey   = 1
+	tagLabelValue = 2
+)
+
+// Address kinds prefix encoded addresses. Addresses whose text form is not
+// canonical are sent as text, so the decoded message is identical to the
+// signed one.
+const (
+	kindText = 0
+	kindIPv4 = 4
+	kindIPv6 = 6
+)
+
+// messageTypes maps message types to their codes, which start at one
+var messageTypes = []string{
+	types.MessageTypeAnnounce,
+	types.MessageTypeQuery,
+	types.MessageTypeResponse,
+	types.MessageTypeLeave,
+	types.MessageTypePing,
+	types.MessageTypePingReq,
+	types.MessageTypeAck,
+}
+
+// ErrTruncated is returned for binary messages that end inside a field
+var ErrTruncated = errors.New("binary message is truncated")
+
+// IsBinary reports whether data is a binary message
+func IsBinary(data []byte) bool {
+	return len(data) >= len(magic) && data[0] == magic[0] && data[1] == magic[1]
+}
+
+// Marshal encodes a message in the binary format. The message's Version is
+// ignored; binary messages are always VersionBinary.
+func Marshal(message *types.MulticastMessage) ([]byte, error) {
+	e := &encoder{}
+	e.buf = append(e.buf, magic[:]...)
+	e.buf = append(e.buf, VersionBinary)
+	e.buf = binary.AppendUvarint(e.buf, message.Features)
+
+	code := -1
+	for i, messageType := range messageTypes {
+		if messageType == message.Type {
+			code = i
+			break
+		}
+	}
+	if code < 0 {
+		return nil, fmt.Errorf("unknown message type %q", message.Type)
+	}
+	e.uint(tagType, uint64(code+1))
+	e.string(tagStackID, message.StackID)
+	e.string(tagDomain, message.Domain)
+	e.address(tagHostIP, message.HostIP)
+	if message.VNI < 0 {
+		return nil, fmt.Errorf("invalid VNI %d", message.VNI)
+	}
+	e.uint(tagVNI, uint64(message.VNI))
+	e.int(tagTimestamp, message.Timestamp)
+	e.uint(tagSeq, message.Seq)
+	if err := e.hex(tagNonce, message.Nonce); err != nil {
+		return nil, fmt.Errorf("invalid nonce: %w", err)
+	}
+	for _, vni := range message.VNIs {
+		if vni < 0 {
+			return nil, fmt.Errorf("invalid VNI %d", vni)
+		}
+		e.field(tagVNIs, binary.AppendUvarint(nil, uint64(vni)))
+	}
+	for _, address := range message.Addresses {
+		e.field(tagAddresses, encodeAddress(address))
+	}
+	e.address(tagVXLANIP, message.VXLANIP)
+	for _, subnet := range message.Subnets {
+		e.field(tagSubnets, encodeSubnet(subnet))
+	}
+	for _, ref := range message.Peers {
+		nested := &encoder{}
+		nested.string(tagRefStackID, ref.StackID)
+		nested.address(tagRefHostIP, ref.HostIP)
+		nested.uint(tagRefPort, uint64(ref.Port))
+		e.field(tagPeers, nested.buf)
+	}
+	e.uint(tagIncarnation, message.Incarnation)
+	e.uint(tagProbeID, message.ProbeID)
+	e.string(tagTarget, message.Target)
+	e.string(tagTargetAddr, message.TargetAddr)
+	for _, update := range message.Updates {
+		nested := &encoder{}
+		nested.string(tagUpdateStackID, update.StackID)
+		nested.string(tagUpdateState, update.State)
+		nested.uint(tagUpdateIncarnation, update.Incarnation)
+		e.field(tagUpdates, nested.buf)
+	}
+
+	if message.AnnounceInterval < 0 {
+		return nil, fmt.Errorf("invalid announce interval %d", message.AnnounceInterval)
+	}
+	e.uint(tagInterval, uint64(message.AnnounceInterval))
+
+	if message.ReplyPort < 0 {
+		return nil, fmt.Errorf("invalid reply port %d", message.ReplyPort)
+	}
+	e.uint(tagReplyPort, uint64(message.ReplyPort))
+
+	// Sort labels so the encoding is deterministic
+	keys := make([]string, 0, len(message.Labels))
+	for key := range message.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		nested := &encoder{}
+		nested.string(tagLabelKey, key)
+		nested.string(tagLabelValue, message.Labels[key])
+		e.field(tagLabels, nested.buf)
+	}
+
+	return e.buf, nil
+}
+
+// Unmarshal decodes a binary message. Messages of a newer version than
+// VersionBinary are rejected, since their fields may mean something else.
+func Unmarshal(data []byte, message *types.MulticastMessage) error {
+	if !IsBinary(data) {
+		return fmt.Errorf("not a binary message")
+	}
+	if len(data) < len(magic)+1 {
+		return ErrTruncated
+	}
+	version := int(data[len(magic)])
+	if version > VersionBinary {
+		return &VersionError{Version: version}
+	}
+
+	features, n := binary.Uvarint(data[len(magic)+1:])
+	if n <= 0 {
+		return ErrTruncated
+	}
+	*message = types.MulticastMessage{Version: version, Features: features}
+
+	return decodeFields(data[len(magic)+1+n:], func(tag uint64, value []byte) error {
+		switch tag {
+		case tagType:
+			code, err := decodeUint(value)
+			if err != nil {
+				return err
+			}
+			if code == 0 || code > uint64(len(messageTypes)) {
+				return fmt.Errorf("unknown message type code %d", code)
+			}
+			message.Type = messageTypes[code-1]
+		case tagStackID:
+			message.StackID = string(value)
+		case tagDomain:
+			message.Domain = string(value)
+		case tagHostIP:
+			return decodeAddress(value, &message.HostIP)
+		case tagVNI:
+			vni, err := decodeInt(value)
+			message.VNI = vni
+			return err
+		case tagTimestamp:
+			timestamp, n := binary.Varint(value)
+			if n <= 0 {
+				return ErrTruncated
+			}
+			message.Timestamp = timestamp
+		case tagSeq:
+			return decodeUintTo(value, &message.Seq)
+		case tagNonce:
+			message.Nonce = hex.EncodeToString(value)
+		case tagVNIs:
+			vni, err := decodeInt(value)
+			message.VNIs = append(message.VNIs, vni)
+			return err
+		case tagAddresses:
+			var address string
+			err := decodeAddress(value, &address)
+			message.Addresses = append(message.Addresses, address)
+			return err
+		case tagVXLANIP:
+			return decodeAddress(value, &message.VXLANIP)
+		case tagSubnets:
+			var subnet string
+			err := decodeSubnet(value, &subnet)
+			message.Subnets = append(message.Subnets, subnet)
+			return err
+		case tagPeers:
+			var ref types.PeerRef
+			err := decodeFields(value, func(tag uint64, value []byte) error {
+				switch tag {
+				case tagRefStackID:
+					ref.StackID = string(value)
+				case tagRefHostIP:
+					return decodeAddress(value, &ref.HostIP)
+				case tagRefPort:
+					port, err := decodeInt(value)
+					ref.Port = port
+					return err
+				}
+				return nil
+			})
+			message.Peers = append(message.Peers, ref)
+			return err
+		case tagIncarnation:
+			return decodeUintTo(value, &message.Incarnation)
+		case tagProbeID:
+			return decodeUintTo(value, &message.ProbeID)
+		case tagTarget:
+			message.Target = string(value)
+		case tagTargetAddr:
+			message.TargetAddr = string(value)
+		case tagUpdates:
+			var update types.MemberUpdate
+			err := decodeFields(value, func(tag uint64, value []byte) error {
+				switch tag {
+				case tagUpdateStackID:
+					update.StackID = string(value)
+				case tagUpdateState:
+					update.State = string(value)
+				case tagUpdateIncarnation:
+					return decodeUintTo(value, &update.Incarnation)
+				}
+				return nil
+			})
+			message.Updates = append(message.Updates, update)
+			return err
+		case tagInterval:
+			interval, err := decodeInt(value)
+			message.AnnounceInterval = interval
+			return err
+		case tagReplyPort:
+			port, err := decodeInt(value)
+			message.ReplyPort = port
+			return err
+		case tagLabels:
+			var labelKey, labelValue string
+			err := decodeFields(value, func(tag uint64, value []byte) error {
+				switch tag {
+				case tagLabelKey:
+					labelKey = string(value)
+				case tagLabelValue:
+					labelValue = string(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if message.Labels == nil {
+				message.Labels = make(map[string]string)
+			}
+			message.Labels[labelKey] = labelValue
+		}
+		return nil
+	})
+}
+
+// VersionError is returned for messages of a version this implementation
+// does not understand
+type VersionError struct {
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("unsupported message version %d (newest supported is %d)", e.Version, VersionBinary)
+}
+
+// encoder appends fields to a buffer. Empty values are left out, matching
+// the omitempty JSON encoding.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) field(tag uint64, value []byte) {
+	e.buf = binary.AppendUvarint(e.buf, tag)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(value)))
+	e.buf = append(e.buf, value...)
+}
+
+func (e *encoder) string(tag uint64, value string) {
+	if value != "" {
+		e.field(tag, []byte(value))
+	}
+}
+
+func (e *encoder) uint(tag uint64, value uint64) {
+	if value != 0 {
+		e.field(tag, binary.AppendUvarint(nil, value))
+	}
+}
+
+func (e *encoder) int(tag uint64, value int64) {
+	if value != 0 {
+		e.field(tag, binary.AppendVarint(nil, value))
+	}
+}
+
+func (e *encoder) hex(tag uint64, value string) error {
+	if value == "" {
+		return nil
+	}
+	raw, err := hex.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(raw) != value {
+		return fmt.Errorf("%q is not lower case hex", value)
+	}
+	e.field(tag, raw)
+	return nil
+}
+
+func (e *encoder) address(tag uint64, value string) {
+	if value != "" {
+		e.field(tag, encodeAddress(value))
+	}
+}
+
+// encodeAddress encodes an IP address in 4 or 16 bytes when its text form
+// is canonical, and as text otherwise
+func encodeAddress(value string) []byte {
+	ip := net.ParseIP(value)
+	switch {
+	case ip == nil || ip.String() != value:
+		return append([]byte{kindText}, value...)
+	case ip.To4() != nil:
+		return append([]byte{kindIPv4}, ip.To4()...)
+	default:
+		return append([]byte{kindIPv6}, ip.To16()...)
+	}
+}
+
+// encodeSubnet encodes a CIDR as an address followed by the prefix length
+// when its text form is canonical, and as text otherwise
+func encodeSubnet(value string) []byte {
+	_, subnet, err := net.ParseCIDR(value)
+	if err != nil || subnet.String() != value {
+		return append([]byte{kindText}, value...)
+	}
+	ones, _ := subnet.Mask.Size()
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		return append(append([]byte{kindIPv4}, ip4...), byte(ones))
+	}
+	return append(append([]byte{kindIPv6}, subnet.IP.To16()...), byte(ones))
+}
+
+// decodeFields calls fn for every field in data
+func decodeFields(data []byte, fn func(tag uint64, value []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrTruncated
+		}
+		data = data[n:]
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length > uint64(len(data)-n) {
+			return ErrTruncated
+		}
+		data = data[n:]
+		if err := fn(tag, data[:length]); err != nil {
+			return fmt.Errorf("field %d: %w", tag, err)
+		}
+		data = data[length:]
+	}
+	return nil
+}
+
+func decodeUint(value []byte) (uint64, error) {
+	v, n := binary.Uvarint(value)
+	if n <= 0 {
+		return 0, ErrTruncated
+	}
+	return v, nil
+}
+
+func decodeUintTo(value []byte, target *uint64) error {
+	v, err := decodeUint(value)
+	*target = v
+	return err
+}
+
+func decodeInt(value []byte) (int, error) {
+	v, err := decodeUint(value)
+	if err != nil {
+		return 0, err
+	}
+	if v > uint64(^uint32(0)) {
+		return 0, fmt.Errorf("value %d out of range", v)
+	}
+	return int(v), nil
+}
+
+// decodeAddress decodes an address written by encodeAddress
+func decodeAddress(value []byte, target *string) error {
+	if len(value) == 0 {
+		return ErrTruncated
+	}
+	kind, raw := value[0], value[1:]
+	switch {
+	case kind == kindText:
+		*target = string(raw)
+	case kind == kindIPv4 && len(raw) == net.IPv4len, kind == kindIPv6 && len(raw) == net.IPv6len:
+		*target = net.IP(raw).String()
+	default:
+		return fmt.Errorf("invalid address encoding")
+	}
+	return nil
+}
+
+// decodeSubnet decodes a CIDR written by encodeSubnet
+func decodeSubnet(value []byte, target *string) error {
+	if len(value) == 0 {
+		return ErrTruncated
+	}
+	kind, raw := value[0], value[1:]
+	switch {
+	case kind == kindText:
+		*target = string(raw)
+	case kind == kindIPv4 && len(raw) == net.IPv4len+1, kind == kindIPv6 && len(raw) == net.IPv6len+1:
+		subnet := net.IPNet{
+			IP:   net.IP(raw[:len(raw)-1]),
+			Mask: net.CIDRMask(int(raw[len(raw)-1]), 8*(len(raw)-1)),
+		}
+		if subnet.Mask == nil {
+			return fmt.Errorf("invalid prefix length %d", raw[len(raw)-1])
+		}
+		*target = subnet.String()
+	default:
+		return fmt.Errorf("invalid subnet encoding")
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/docker-router/discovery/pkg/types"
+)
+
+// testMessages are messages covering every field of the binary format
+var testMessages = []struct {
+	name    string
+	message types.MulticastMessage
+}{
+	{
+		name: "minimal",
+		message: types.MulticastMessage{
+			Type:    types.MessageTypeQuery,
+			StackID: "stack-a",
+		},
+	},
+	{
+		name: "announce",
+		message: types.MulticastMessage{
+			Type:             types.MessageTypeAnnounce,
+			StackID:          "stack-a",
+			Domain:           "prod",
+			HostIP:           "192.168.1.10",
+			VNI:              100,
+			Timestamp:        1700000000,
+			Seq:              42,
+			Features:         uint64(FeatureBinary | FeatureSubnets | FeatureLabels | FeatureFragments),
+			Nonce:            "00ff10a0",
+			VNIs:             []int{100, 200},
+			Addresses:        []string{"192.168.1.10", "2001:db8::10"},
+			VXLANIP:          "10.200.0.1",
+			Subnets:          []string{"172.20.0.0/16", "2001:db8:1::/64"},
+			Labels:           map[string]string{"zone": "a", "rack": "7"},
+			AnnounceInterval: 30,
+			ReplyPort:        40123,
+		},
+	},
+	{
+		name: "non-canonical addresses",
+		message: types.MulticastMessage{
+			Type:      types.MessageTypeResponse,
+			StackID:   "stack-b",
+			HostIP:    "host.example.com",
+			Addresses: []string{"host.example.com", "2001:DB8::1"},
+			Subnets:   []string{"10.0.0.5/24"},
+			Peers: []types.PeerRef{
+				{StackID: "stack-c", HostIP: "10.0.0.3", Port: 4790},
+				{StackID: "stack-d", HostIP: "fe80::1", Port: 4791},
+			},
+		},
+	},
+	{
+		name: "gossip",
+		message: types.MulticastMessage{
+			Type:        types.MessageTypePingReq,
+			StackID:     "stack-a",
+			Timestamp:   -1,
+			Incarnation: 7,
+			ProbeID:     1 << 63,
+			Target:      "stack-b",
+			TargetAddr:  "10.0.0.2:40000",
+			Updates: []types.MemberUpdate{
+				{StackID: "stack-b", State: "suspect", Incarnation: 3},
+				{StackID: "stack-c", State: "dead", Incarnation: 1},
+			},
+		},
+	},
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	for _, tt := range testMessages {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := Marshal(&tt.message)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			if !IsBinary(data) {
+				t.Fatalf("Marshal output does not start with the binary magic")
+			}
+
+			var decoded types.MulticastMessage
+			if err := Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+
+			want := tt.message
+			want.Version = VersionBinary
+			if !reflect.DeepEqual(decoded, want) {
+				t.Errorf("round trip mismatch\n got: %+v\nwant: %+v", decoded, want)
+			}
+		})
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		message types.MulticastMessage
+	}{
+		{"unknown type", types.MulticastMessage{Type: "BOGUS"}},
+		{"invalid nonce", types.MulticastMessage{Type: types.MessageTypeAnnounce, Nonce: "xyz"}},
+		{"upper case nonce", types.MulticastMessage{Type: types.MessageTypeAnnounce, Nonce: "ABCD"}},
+		{"negative interval", types.MulticastMessage{Type: types.MessageTypeAnnounce, AnnounceInterval: -1}},
+		{"negative reply port", types.MulticastMessage{Type: types.MessageTypeAnnounce, ReplyPort: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Marshal(&tt.message); err == nil {
+				t.Errorf("Marshal succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestUnmarshalTruncated(t *testing.T) {
+	data, err := Marshal(&testMessages[1].message)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	// Every proper prefix ends inside the header or a field, except those
+	// ending exactly on a field boundary
+	boundaries := fieldBoundaries(t, data)
+	for length := 0; length < len(data); length++ {
+		var decoded types.MulticastMessage
+		err := Unmarshal(data[:length], &decoded)
+		switch {
+		case length < len(magic):
+			if err == nil {
+				t.Errorf("prefix of %d bytes: Unmarshal succeeded, want an error", length)
+			}
+		case boundaries[length]:
+			if err != nil {
+				t.Errorf("prefix of %d bytes ends on a field boundary: %v", length, err)
+			}
+		case !errors.Is(err, ErrTruncated):
+			t.Errorf("prefix of %d bytes: got %v, want ErrTruncated", length, err)
+		}
+	}
+}
+
+// fieldBoundaries returns the offsets in data at which a field ends
+func fieldBoundaries(t *testing.T, data []byte) map[int]bool {
+	t.Helper()
+
+	_, n := binary.Uvarint(data[len(magic)+1:])
+	offset := len(magic) + 1 + n
+	boundaries := map[int]bool{offset: true}
+	for offset < len(data) {
+		_, n := binary.Uvarint(data[offset:])
+		offset += n
+		length, n := binary.Uvarint(data[offset:])
+		offset += n + int(length)
+		boundaries[offset] = true
+	}
+	return boundaries
+}
+
+func TestUnmarshalOversized(t *testing.T) {
+	header := append(magic[:], VersionBinary, 0)
+
+	tests := []struct {
+		name  string
+		field []byte
+	}{
+		{"length beyond end", field(tagStackID, []byte("abc"))[:4]},
+		{"huge length", binary.AppendUvarint(binary.AppendUvarint(nil, tagStackID), 1<<62)},
+		{"vni out of range", field(tagVNI, binary.AppendUvarint(nil, 1<<40))},
+		{"reply port out of range", field(tagReplyPort, binary.AppendUvarint(nil, 1<<33))},
+		{"address too long", field(tagHostIP, append([]byte{kindIPv4}, make([]byte, 5)...))},
+		{"prefix too long", field(tagSubnets, []byte{kindIPv4, 10, 0, 0, 0, 33})},
+		{"unknown type code", field(tagType, binary.AppendUvarint(nil, 99))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append(append([]byte{}, header...), tt.field...)
+			var decoded types.MulticastMessage
+			if err := Unmarshal(data, &decoded); err == nil {
+				t.Errorf("Unmarshal succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestUnmarshalNewerVersion(t *testing.T) {
+	data := append(magic[:], VersionBinary+1, 0)
+	var decoded types.MulticastMessage
+	err := Unmarshal(data, &decoded)
+
+	var versionErr *VersionError
+	if !errors.As(err, &versionErr) || versionErr.Version != VersionBinary+1 {
+		t.Errorf("got %v, want a VersionError for version %d", err, VersionBinary+1)
+	}
+}
+
+func TestUnmarshalSkipsUnknownFields(t *testing.T) {
+	message := testMessages[1].message
+	data, err := Marshal(&message)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	// Unknown fields before and after the known ones, including one
+	// whose tag needs more than one byte
+	_, n := binary.Uvarint(data[len(magic)+1:])
+	fields := len(magic) + 1 + n
+	extended := append([]byte{}, data[:fields]...)
+	extended = append(extended, field(200, []byte("future"))...)
+	extended = append(extended, data[fields:]...)
+	extended = append(extended, field(23, nil)...)
+	extended = append(extended, field(1<<20, []byte{0xff, 0xff})...)
+
+	var decoded types.MulticastMessage
+	if err := Unmarshal(extended, &decoded); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	message.Version = VersionBinary
+	if !reflect.DeepEqual(decoded, message) {
+		t.Errorf("unknown fields changed the message\n got: %+v\nwant: %+v", decoded, message)
+	}
+}
+
+// field encodes one tag-length-value field
+func field(tag uint64, value []byte) []byte {
+	e := &encoder{}
+	e.field(tag, value)
+	return e.buf
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, tt := range testMessages {
+		data, err := Marshal(&tt.message)
+		if err != nil {
+			f.Fatalf("Marshal %s: %v", tt.name, err)
+		}
+		f.Add(data)
+	}
+	f.Add(append(magic[:], VersionBinary, 0))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var decoded types.MulticastMessage
+		if err := Unmarshal(data, &decoded); err != nil || decoded.Type == "" {
+			// Messages without a type decode but cannot be sent
+			return
+		}
+
+		// Whatever decodes must encode again and decode to the same message
+		encoded, err := Marshal(&decoded)
+		if err != nil {
+			t.Fatalf("Marshal of decoded message: %v", err)
+		}
+		var again types.MulticastMessage
+		if err := Unmarshal(encoded, &again); err != nil {
+			t.Fatalf("Unmarshal of re-encoded message: %v", err)
+		}
+		decoded.Version = VersionBinary
+		if !reflect.DeepEqual(again, decoded) {
+			t.Errorf("re-encoding changed the message\n got: %+v\nwant: %+v", again, decoded)
+		}
+	})
+}
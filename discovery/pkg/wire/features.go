@@ -0,0 +1,68 @@
+package wire
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Features is a bit set of optional protocol capabilities. Every message
+// carries the sender's features, so peers of different versions can tell
+// what the other side understands.
+type Features uint64
+
+const (
+	// FeatureBinary means the sender decodes the binary wire format
+	FeatureBinary Features = 1 << iota
+	// FeatureMultiVNI means the sender understands the VNI list
+	FeatureMultiVNI
+	// FeatureSubnets means the sender advertises and routes container subnets
+	FeatureSubnets
+	// FeatureLabels means the sender understands peer labels
+	FeatureLabels
+	// FeatureAuth means the sender signs its messages
+	FeatureAuth
+	// FeatureFragments means the sender reassembles fragmented messages
+	FeatureFragments
+)
+
+// featureNames names the known features in bit order
+var featureNames = []struct {
+	feature Features
+	name    string
+}{
+	{FeatureBinary, "binary"},
+	{FeatureMultiVNI, "multi_vni"},
+	{FeatureSubnets, "subnets"},
+	{FeatureLabels, "labels"},
+	{FeatureAuth, "auth"},
+	{FeatureFragments, "fragments"},
+}
+
+// Has reports whether every feature in want is set
+func (f Features) Has(want Features) bool {
+	return f&want == want
+}
+
+// Names returns the names of the set features. Bits unknown to this version
+// are reported as "bit<N>".
+func (f Features) Names() []string {
+	var names []string
+	known := Features(0)
+	for _, entry := range featureNames {
+		known |= entry.feature
+		if f.Has(entry.feature) {
+			names = append(names, entry.name)
+		}
+	}
+	for bit := 0; bit < 64; bit++ {
+		if unknown := f &^ known; unknown&(1<<bit) != 0 {
+			names = append(names, fmt.Sprintf("bit%d", bit))
+		}
+	}
+	return names
+}
+
+// String returns the feature names separated by commas
+func (f Features) String() string {
+	return strings.Join(f.Names(), ",")
+}
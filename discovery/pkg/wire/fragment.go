@@ -0,0 +1,230 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxFragments is the most datagrams one message may be split into
+	MaxFragments = 64
+	// DefaultFragmentTimeout is how long the fragments of an incomplete
+	// message are kept waiting for the rest
+	DefaultFragmentTimeout = 5 * time.Second
+	// MaxPendingMessages bounds the number of messages being reassembled at
+	// once, so a flood of stray fragments cannot use unbounded memory
+	MaxPendingMessages = 128
+	// MaxPendingPerSource bounds the messages being reassembled from one
+	// source, so a single sender cannot take every pending slot
+	MaxPendingPerSource = 16
+	// MaxPendingBytes bounds the fragment payload buffered across all
+	// messages being reassembled
+	MaxPendingBytes = 4 << 20
+)
+
+// fragmentMagic starts every fragment. A fragment is the magic, the message
+// ID as a uvarint, the fragment index and the fragment count, followed by
+// its part of the encoded message.
+var fragmentMagic = [2]byte{0xd7, 'F'}
+
+// fragmentHeaderSize is the largest possible fragment header
+const fragmentHeaderSize = len(fragmentMagic) + binary.MaxVarintLen64 + 2
+
+var (
+	// ErrTooLarge is returned for messages that need more than MaxFragments
+	ErrTooLarge = errors.New("message is too large to fragment")
+	// ErrTooManyPending is returned when a fragment would start a new
+	// message while MaxPendingMessages are already being reassembled
+	ErrTooManyPending = errors.New("too many messages being reassembled")
+	// ErrFragmentTooLarge is returned for fragments above the maximum
+	// fragment size
+	ErrFragmentTooLarge = errors.New("fragment is too large")
+	// ErrPendingBytes is returned when a fragment would take the buffered
+	// payload above MaxPendingBytes
+	ErrPendingBytes = errors.New("too many fragment bytes buffered")
+)
+
+// IsFragment reports whether data is a fragment of a larger message
+func IsFragment(data []byte) bool {
+	return len(data) >= len(fragmentMagic) && data[0] == fragmentMagic[0] && data[1] == fragmentMagic[1]
+}
+
+// Fragment splits an encoded message into datagrams of at most maxSize
+// bytes. A message that already fits is returned as the only datagram,
+// unchanged, so peers that cannot reassemble still receive small messages.
+func Fragment(data []byte, id uint64, maxSize int) ([][]byte, error) {
+	if len(data) <= maxSize {
+		return [][]byte{data}, nil
+	}
+
+	chunk := maxSize - fragmentHeaderSize
+	if chunk <= 0 {
+		return nil, fmt.Errorf("datagram size %d is too small for fragments", maxSize)
+	}
+	count := (len(data) + chunk - 1) / chunk
+	if count > MaxFragments {
+		return nil, fmt.Errorf("%w: %d bytes need %d fragments, at most %d are allowed", ErrTooLarge, len(data), count, MaxFragments)
+	}
+
+	fragments := make([][]byte, 0, count)
+	for index := 0; index < count; index++ {
+		end := (index + 1) * chunk
+		if end > len(data) {
+			end = len(data)
+		}
+		fragment := append([]byte{}, fragmentMagic[:]...)
+		fragment = binary.AppendUvarint(fragment, id)
+		fragment = append(fragment, byte(index), byte(count))
+		fragment = append(fragment, data[index*chunk:end]...)
+		fragments = append(fragments, fragment)
+	}
+	return fragments, nil
+}
+
+// partialMessage collects the fragments of one message
+type partialMessage struct {
+	source   string
+	parts    [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// Reassembler joins fragments back into messages. Fragments are grouped by
+// source and message ID; incomplete messages are dropped after the timeout.
+type Reassembler struct {
+	mutex           sync.Mutex
+	pending         map[string]*partialMessage
+	perSource       map[string]int
+	buffered        int
+	timeout         time.Duration
+	maxFragmentSize int
+}
+
+// NewReassembler creates a reassembler that waits up to timeout for the
+// fragments of a message
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		pending:   make(map[string]*partialMessage),
+		perSource: make(map[string]int),
+		timeout:   timeout,
+	}
+}
+
+// SetMaxFragmentSize rejects fragments larger than size bytes, the largest
+// datagram a peer sends; zero accepts any size
+func (r *Reassembler) SetMaxFragmentSize(size int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.maxFragmentSize = size
+}
+
+// Add adds a fragment received from source. It returns the reassembled
+// message once the last fragment arrives, and nil before that.
+func (r *Reassembler) Add(source string, data []byte) ([]byte, error) {
+	if !IsFragment(data) {
+		return nil, fmt.Errorf("not a fragment")
+	}
+	id, n := binary.Uvarint(data[len(fragmentMagic):])
+	if n <= 0 || len(data) < len(fragmentMagic)+n+2 {
+		return nil, ErrTruncated
+	}
+	header := len(fragmentMagic) + n
+	index, count := int(data[header]), int(data[header+1])
+	if count == 0 || count > MaxFragments || index >= count {
+		return nil, fmt.Errorf("invalid fragment %d of %d", index, count)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.maxFragmentSize > 0 && len(data) > r.maxFragmentSize {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d are allowed", ErrFragmentTooLarge, len(data), r.maxFragmentSize)
+	}
+	payload := data[header+2:]
+	if r.buffered+len(payload) > MaxPendingBytes {
+		if r.expire(); r.buffered+len(payload) > MaxPendingBytes {
+			return nil, ErrPendingBytes
+		}
+	}
+
+	key := fmt.Sprintf("%s/%d", source, id)
+	partial, exists := r.pending[key]
+	if !exists {
+		if r.full(source) {
+			// Make room by dropping timed out messages first
+			if r.expire(); r.full(source) {
+				return nil, ErrTooManyPending
+			}
+		}
+		partial = &partialMessage{source: source, parts: make([][]byte, count), started: time.Now()}
+		r.pending[key] = partial
+		r.perSource[source]++
+	}
+	if len(partial.parts) != count {
+		r.remove(key, partial)
+		return nil, fmt.Errorf("fragment count changed from %d to %d", len(partial.parts), count)
+	}
+	if partial.parts[index] != nil {
+		// Duplicate fragment
+		return nil, nil
+	}
+
+	// Copy the payload, since the caller reuses its read buffer
+	partial.parts[index] = append([]byte{}, payload...)
+	partial.received++
+	partial.size += len(payload)
+	r.buffered += len(payload)
+	if partial.received < count {
+		return nil, nil
+	}
+
+	r.remove(key, partial)
+	var message []byte
+	for _, part := range partial.parts {
+		message = append(message, part...)
+	}
+	if IsFragment(message) {
+		return nil, fmt.Errorf("reassembled message is itself a fragment")
+	}
+	return message, nil
+}
+
+// Expire drops incomplete messages older than the timeout and returns how
+// many were dropped
+func (r *Reassembler) Expire() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.expire()
+}
+
+// expire drops timed out messages; the caller must hold the mutex
+func (r *Reassembler) expire() int {
+	expired := 0
+	for key, partial := range r.pending {
+		if time.Since(partial.started) > r.timeout {
+			r.remove(key, partial)
+			expired++
+		}
+	}
+	return expired
+}
+
+// full reports whether no further message from source can be reassembled;
+// the caller must hold the mutex
+func (r *Reassembler) full(source string) bool {
+	return len(r.pending) >= MaxPendingMessages || r.perSource[source] >= MaxPendingPerSource
+}
+
+// remove forgets a pending message and releases its buffered bytes; the
+// caller must hold the mutex
+func (r *Reassembler) remove(key string, partial *partialMessage) {
+	delete(r.pending, key)
+	r.buffered -= partial.size
+	if r.perSource[partial.source]--; r.perSource[partial.source] <= 0 {
+		delete(r.perSource, partial.source)
+	}
+}
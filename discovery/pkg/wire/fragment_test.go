@@ -0,0 +1,294 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// testPayload returns n bytes of deterministic, non-repeating data
+func testPayload(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	// A payload must not itself look like a fragment
+	data[0] = '{'
+	return data
+}
+
+// split fragments data and fails the test on error
+func split(t *testing.T, data []byte, id uint64, maxSize int) [][]byte {
+	t.Helper()
+	fragments, err := Fragment(data, id, maxSize)
+	if err != nil {
+		t.Fatalf("Fragment: %v", err)
+	}
+	return fragments
+}
+
+func TestFragmentSmallMessage(t *testing.T) {
+	data := testPayload(100)
+	fragments := split(t, data, 1, 100)
+	if len(fragments) != 1 || !bytes.Equal(fragments[0], data) {
+		t.Fatalf("a message that fits must be sent unchanged, got %d datagrams", len(fragments))
+	}
+	if IsFragment(fragments[0]) {
+		t.Errorf("a message that fits must not be a fragment")
+	}
+}
+
+func TestFragmentSizes(t *testing.T) {
+	tests := []struct {
+		size    int
+		maxSize int
+		count   int
+	}{
+		{1025, 1024, 2},
+		{4000, 1024, 4},
+		{8192 * 3, 8192, 4},
+		{(1024 - fragmentHeaderSize) * MaxFragments, 1024, MaxFragments},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d in %d", tt.size, tt.maxSize), func(t *testing.T) {
+			fragments := split(t, testPayload(tt.size), 7, tt.maxSize)
+			if len(fragments) != tt.count {
+				t.Errorf("got %d fragments, want %d", len(fragments), tt.count)
+			}
+			for i, fragment := range fragments {
+				if !IsFragment(fragment) {
+					t.Errorf("fragment %d does not start with the fragment magic", i)
+				}
+				if len(fragment) > tt.maxSize {
+					t.Errorf("fragment %d is %d bytes, above the limit of %d", i, len(fragment), tt.maxSize)
+				}
+			}
+		})
+	}
+}
+
+func TestFragmentTooLarge(t *testing.T) {
+	size := (1024-fragmentHeaderSize)*MaxFragments + 1
+	if _, err := Fragment(testPayload(size), 1, 1024); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, want ErrTooLarge", err)
+	}
+	if _, err := Fragment(testPayload(100), 1, fragmentHeaderSize); err == nil {
+		t.Errorf("fragmenting into datagrams with no room for data succeeded")
+	}
+}
+
+func TestReassembleOrders(t *testing.T) {
+	data := testPayload(5000)
+	fragments := split(t, data, 42, 1024)
+
+	orders := map[string][]int{
+		"in order": {0, 1, 2, 3, 4},
+		"reversed": {4, 3, 2, 1, 0},
+		"shuffled": {2, 0, 4, 1, 3},
+	}
+	for name, order := range orders {
+		t.Run(name, func(t *testing.T) {
+			r := NewReassembler(DefaultFragmentTimeout)
+			for i, index := range order {
+				message, err := r.Add("10.0.0.1:4790", fragments[index])
+				if err != nil {
+					t.Fatalf("Add fragment %d: %v", index, err)
+				}
+				last := i == len(order)-1
+				if !last && message != nil {
+					t.Fatalf("message completed after %d of %d fragments", i+1, len(order))
+				}
+				if last && !bytes.Equal(message, data) {
+					t.Fatalf("reassembled message differs from the original")
+				}
+			}
+		})
+	}
+}
+
+func TestReassembleDuplicates(t *testing.T) {
+	data := testPayload(3000)
+	fragments := split(t, data, 1, 1024)
+	r := NewReassembler(DefaultFragmentTimeout)
+
+	for i := 0; i < 2; i++ {
+		if message, err := r.Add("src", fragments[0]); err != nil || message != nil {
+			t.Fatalf("Add duplicate first fragment: message %v, error %v", message != nil, err)
+		}
+	}
+	var message []byte
+	for _, fragment := range fragments[1:] {
+		var err error
+		if message, err = r.Add("src", fragment); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if !bytes.Equal(message, data) {
+		t.Fatalf("duplicate fragment corrupted the message")
+	}
+
+	// A fragment arriving after the message completed starts a new message
+	// that never completes, instead of delivering the message twice
+	if message, err := r.Add("src", fragments[1]); err != nil || message != nil {
+		t.Errorf("late duplicate: message %v, error %v", message != nil, err)
+	}
+}
+
+func TestReassembleMissingFragment(t *testing.T) {
+	fragments := split(t, testPayload(3000), 1, 1024)
+	r := NewReassembler(DefaultFragmentTimeout)
+
+	for _, fragment := range fragments[:len(fragments)-1] {
+		if message, err := r.Add("src", fragment); err != nil || message != nil {
+			t.Fatalf("Add: message %v, error %v", message != nil, err)
+		}
+	}
+	if expired := r.Expire(); expired != 0 {
+		t.Errorf("expired %d messages before the timeout", expired)
+	}
+}
+
+func TestReassembleExpired(t *testing.T) {
+	data := testPayload(3000)
+	fragments := split(t, data, 1, 1024)
+	r := NewReassembler(10 * time.Millisecond)
+
+	if _, err := r.Add("src", fragments[0]); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if expired := r.Expire(); expired != 1 {
+		t.Fatalf("expired %d messages, want 1", expired)
+	}
+
+	// The rest of an expired message does not complete it
+	for _, fragment := range fragments[1:] {
+		if message, err := r.Add("src", fragment); err != nil || message != nil {
+			t.Fatalf("Add after expiry: message %v, error %v", message != nil, err)
+		}
+	}
+}
+
+func TestReassembleSeparatesSources(t *testing.T) {
+	a, b := testPayload(3000), testPayload(3001)
+	fragmentsA, fragmentsB := split(t, a, 5, 1024), split(t, b, 5, 1024)
+	r := NewReassembler(DefaultFragmentTimeout)
+
+	var messageA, messageB []byte
+	for i := range fragmentsA {
+		var err error
+		if messageA, err = r.Add("10.0.0.1:4790", fragmentsA[i]); err != nil {
+			t.Fatalf("Add from a: %v", err)
+		}
+		if messageB, err = r.Add("10.0.0.2:4790", fragmentsB[i]); err != nil {
+			t.Fatalf("Add from b: %v", err)
+		}
+	}
+	if !bytes.Equal(messageA, a) || !bytes.Equal(messageB, b) {
+		t.Errorf("fragments with the same message ID from different sources were mixed")
+	}
+}
+
+func TestReassembleInvalid(t *testing.T) {
+	fragments := split(t, testPayload(3000), 1, 1024)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not a fragment", []byte("{}")},
+		{"truncated header", fragments[0][:len(fragmentMagic)+1]},
+		{"zero count", append(append([]byte{}, fragmentMagic[:]...), 1, 0, 0)},
+		{"index beyond count", append(append([]byte{}, fragmentMagic[:]...), 1, 3, 3)},
+		{"too many fragments", append(append([]byte{}, fragmentMagic[:]...), 1, 0, MaxFragments+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewReassembler(DefaultFragmentTimeout).Add("src", tt.data); err == nil {
+				t.Errorf("Add succeeded, want an error")
+			}
+		})
+	}
+
+	t.Run("count changed", func(t *testing.T) {
+		r := NewReassembler(DefaultFragmentTimeout)
+		if _, err := r.Add("src", fragments[0]); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+		other := split(t, testPayload(5000), 1, 1024)
+		if _, err := r.Add("src", other[1]); err == nil {
+			t.Errorf("Add with a different count succeeded, want an error")
+		}
+	})
+}
+
+func TestReassembleLimits(t *testing.T) {
+	t.Run("fragment size", func(t *testing.T) {
+		r := NewReassembler(DefaultFragmentTimeout)
+		r.SetMaxFragmentSize(512)
+		fragments := split(t, testPayload(3000), 1, 1024)
+		if _, err := r.Add("src", fragments[0]); !errors.Is(err, ErrFragmentTooLarge) {
+			t.Errorf("got %v, want ErrFragmentTooLarge", err)
+		}
+	})
+
+	t.Run("pending per source", func(t *testing.T) {
+		r := NewReassembler(DefaultFragmentTimeout)
+		data := testPayload(3000)
+		for id := uint64(0); id < MaxPendingPerSource; id++ {
+			if _, err := r.Add("src", split(t, data, id, 1024)[0]); err != nil {
+				t.Fatalf("Add message %d: %v", id, err)
+			}
+		}
+		if _, err := r.Add("src", split(t, data, MaxPendingPerSource, 1024)[0]); !errors.Is(err, ErrTooManyPending) {
+			t.Errorf("got %v, want ErrTooManyPending", err)
+		}
+		// Other sources are unaffected
+		if _, err := r.Add("other", split(t, data, 0, 1024)[0]); err != nil {
+			t.Errorf("Add from another source: %v", err)
+		}
+	})
+
+	t.Run("pending messages", func(t *testing.T) {
+		r := NewReassembler(DefaultFragmentTimeout)
+		data := testPayload(3000)
+		for i := 0; i < MaxPendingMessages; i++ {
+			source := fmt.Sprintf("10.0.%d.%d:4790", i/256, i%256)
+			if _, err := r.Add(source, split(t, data, 1, 1024)[0]); err != nil {
+				t.Fatalf("Add message %d: %v", i, err)
+			}
+		}
+		if _, err := r.Add("10.1.0.0:4790", split(t, data, 1, 1024)[0]); !errors.Is(err, ErrTooManyPending) {
+			t.Errorf("got %v, want ErrTooManyPending", err)
+		}
+	})
+
+	t.Run("pending bytes", func(t *testing.T) {
+		r := NewReassembler(DefaultFragmentTimeout)
+		maxSize := 65000
+		data := testPayload(maxSize * 2)
+		var err error
+		for i := 0; i < MaxPendingMessages && err == nil; i++ {
+			source := fmt.Sprintf("10.0.%d.%d:4790", i/256, i%256)
+			_, err = r.Add(source, split(t, data, 1, maxSize)[0])
+		}
+		if !errors.Is(err, ErrPendingBytes) {
+			t.Errorf("got %v, want ErrPendingBytes", err)
+		}
+	})
+
+	t.Run("expiry frees room", func(t *testing.T) {
+		r := NewReassembler(10 * time.Millisecond)
+		data := testPayload(3000)
+		for id := uint64(0); id < MaxPendingPerSource; id++ {
+			if _, err := r.Add("src", split(t, data, id, 1024)[0]); err != nil {
+				t.Fatalf("Add message %d: %v", id, err)
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		if _, err := r.Add("src", split(t, data, MaxPendingPerSource, 1024)[0]); err != nil {
+			t.Errorf("Add after the pending messages timed out: %v", err)
+		}
+	})
+}
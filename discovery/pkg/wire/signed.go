@@ -0,0 +1,38 @@
+package wire
+
+import "errors"
+
+// signedMagic starts every signed message. A signed message is the magic, the
+// signature length as one byte and the signature, followed by the encoded
+// message exactly as it was signed. Keeping the signature outside the
+// message lets receivers verify the bytes they received, including fields
+// they do not know.
+var signedMagic = [2]byte{0xd7, 'S'}
+
+// ErrBadEnvelope is returned for signed messages that end inside the
+// signature
+var ErrBadEnvelope = errors.New("signed message is truncated")
+
+// IsSigned reports whether data is a signed message
+func IsSigned(data []byte) bool {
+	return len(data) >= len(signedMagic) && data[0] == signedMagic[0] && data[1] == signedMagic[1]
+}
+
+// Seal wraps an encoded message and its signature into a signed message
+func Seal(signature, payload []byte) []byte {
+	data := make([]byte, 0, len(signedMagic)+1+len(signature)+len(payload))
+	data = append(data, signedMagic[:]...)
+	data = append(data, byte(len(signature)))
+	data = append(data, signature...)
+	return append(data, payload...)
+}
+
+// Open splits a signed message into the encoded message and its signature
+func Open(data []byte) (payload, signature []byte, err error) {
+	header := len(signedMagic) + 1
+	if len(data) < header || len(data) < header+int(data[len(signedMagic)]) {
+		return nil, nil, ErrBadEnvelope
+	}
+	end := header + int(data[len(signedMagic)])
+	return data[end:], data[header:end], nil
+}
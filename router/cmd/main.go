@@ -27,6 +27,10 @@ type Router struct {
 	fdbManager    *fdb.Manager
 	routeManager  *routing.Manager
 	discoveryWatcher *discovery.Watcher
+	// hostIP is the local underlay address the VXLAN interface is bound to
+	hostIP string
+	// discoveryFile is the discovery file of this router's VNI
+	discoveryFile string
 }
 
 // NewRouter creates a new router instance
@@ -57,10 +61,15 @@ func NewRouter(configFile string) (*Router, error) {
 		vxlanManager: vxlanManager,
 		fdbManager:   fdbManager,
 		routeManager: routeManager,
+		// A discovery daemon serving several VNIs writes one file per VNI
+		discoveryFile: DefaultDiscoveryFile,
+	}
+	if envDiscoveryFile := os.Getenv("DISCOVERY_FILE"); envDiscoveryFile != "" {
+		router.discoveryFile = envDiscoveryFile
 	}
 
 	// Create discovery watcher
-	discoveryWatcher, err := discovery.NewWatcher(DefaultDiscoveryFile, router.onPeersUpdated)
+	discoveryWatcher, err := discovery.NewWatcher(router.discoveryFile, router.onPeersUpdated)
 	if err != nil {
 		return nil, err
 	}
@@ -126,8 +135,14 @@ func (r *Router) onPeersUpdated(peers []discovery.Peer) {
 	// Extract host IPs for FDB management
 	var hostIPs []string
 	for _, peer := range peers {
-		hostIPs = append(hostIPs, peer.HostIP)
-		log.Printf("Peer: %s (host: %s, VNI: %d)", peer.StackID, peer.HostIP, peer.VNI)
+		// Only the keep policy still forwards to stale peers
+		if peer.IsStale() && r.config.StalePolicy != config.StalePolicyKeep {
+			log.Printf("Peer: %s is stale, skipping FDB entry (policy: %s)", peer.StackID, r.config.StalePolicy)
+			continue
+		}
+		hostIP := peer.UnderlayIP(r.hostIP)
+		hostIPs = append(hostIPs, hostIP)
+		log.Printf("Peer: %s (host: %s, VNI: %d)", peer.StackID, hostIP, peer.VNI)
 	}
 
 	// Update FDB entries
@@ -145,10 +160,10 @@ func (r *Router) onPeersUpdated(peers []discovery.Peer) {
 
 // waitForDiscoveryFile waits for the discovery file to appear
 func (r *Router) waitForDiscoveryFile() error {
-	log.Printf("Waiting for discovery file: %s", DefaultDiscoveryFile)
+	log.Printf("Waiting for discovery file: %s", r.discoveryFile)
 
 	for {
-		if _, err := os.Stat(DefaultDiscoveryFile); err == nil {
+		if _, err := os.Stat(r.discoveryFile); err == nil {
 			log.Printf("Discovery file found")
 			return nil
 		}
@@ -161,7 +176,7 @@ func (r *Router) waitForDiscoveryFile() error {
 // setupVXLANInterface detects the underlying device and creates the VXLAN interface
 func (r *Router) setupVXLANInterface() error {
 	// Load discovery data to find the first peer for device detection
-	peers, err := discovery.LoadDiscoveryData(DefaultDiscoveryFile)
+	peers, err := discovery.LoadDiscoveryData(r.discoveryFile)
 	if err != nil {
 		return err
 	}
@@ -181,6 +196,7 @@ func (r *Router) setupVXLANInterface() error {
 			return fmt.Errorf("failed to detect host IP: %v", err)
 		}
 		log.Printf("Detected host IP: %s, underlying device: %s", hostIP, underlyingDev)
+		r.hostIP = hostIP
 	} else {
 		return fmt.Errorf("no peers found in discovery file")
 	}
@@ -3,10 +3,13 @@ module github.com/docker-router/router
 go 1.21
 
 require (
+	github.com/docker-router/schema v0.0.0
 	github.com/fsnotify/fsnotify v1.7.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	golang.org/x/sys v0.4.0 // indirect
-)
\ No newline at end of file
+)
+
+replace github.com/docker-router/schema => ../schema
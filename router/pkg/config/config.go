@@ -17,8 +17,20 @@ type Config struct {
 	LocalVXLANIP    string                 `yaml:"local_vxlan_ip"`
 	ContainerSubnet string                 `yaml:"container_subnet"`
 	StackMappings   map[string]StackConfig `yaml:"stack_mappings"`
+	StalePolicy     string                 `yaml:"stale_policy"`
 }
 
+// Stale policies decide what happens to a peer's routes while discovery
+// reports it as stale
+const (
+	// StalePolicyKeep keeps routing to the peer until it is removed
+	StalePolicyKeep = "keep"
+	// StalePolicyBlackhole replaces the peer's routes with blackhole routes
+	StalePolicyBlackhole = "blackhole"
+	// StalePolicyWithdraw removes the peer's routes immediately
+	StalePolicyWithdraw = "withdraw"
+)
+
 // StackConfig represents configuration for a specific stack
 type StackConfig struct {
 	VXLANIP         string `yaml:"vxlan_ip"`
@@ -41,6 +53,17 @@ func LoadConfig(configFile string) (*Config, error) {
 	if stackID := os.Getenv("STACK_ID"); stackID != "" {
 		config.StackID = stackID
 	}
+	if stalePolicy := os.Getenv("STALE_POLICY"); stalePolicy != "" {
+		config.StalePolicy = stalePolicy
+	}
+
+	switch config.StalePolicy {
+	case "":
+		config.StalePolicy = StalePolicyWithdraw
+	case StalePolicyKeep, StalePolicyBlackhole, StalePolicyWithdraw:
+	default:
+		return nil, fmt.Errorf("invalid stale_policy %q (want keep, blackhole or withdraw)", config.StalePolicy)
+	}
 
 	return &config, nil
 }
@@ -0,0 +1,33 @@
+package discovery
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/docker-router/schema"
+)
+
+// readDiscoveryFile reads the discovery file under the shared lock of its
+// directory, so a discovery daemon never replaces it mid-read. Without a
+// lock file, as when only the file itself is mounted, it is read unlocked.
+func readDiscoveryFile(discoveryFile string) ([]byte, error) {
+	lock, err := os.Open(filepath.Join(filepath.Dir(discoveryFile), schema.LockFile))
+	if err == nil {
+		defer lock.Close()
+		if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_SH); err != nil {
+			return nil, fmt.Errorf("failed to lock discovery file: %v", err)
+		}
+		defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(discoveryFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read discovery file: %v", err)
+	}
+	return data, nil
+}
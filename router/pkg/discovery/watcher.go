@@ -1,30 +1,25 @@
 package discovery
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"path/filepath"
 	"time"
 
+	"github.com/docker-router/schema"
 	"github.com/fsnotify/fsnotify"
 )
 
-// Peer represents a discovered peer
-type Peer struct {
-	StackID       string    `json:"stack_id"`
-	HostIP        string    `json:"host_ip"`
-	VXLANEndpoint string    `json:"vxlan_endpoint"`
-	VNI           int       `json:"vni"`
-	LastSeen      time.Time `json:"last_seen"`
-	Status        string    `json:"status"`
-}
+// Peer is a discovered peer as listed in the discovery file
+type Peer = schema.Peer
 
-// DiscoveryData represents the discovery file structure
-type DiscoveryData struct {
-	Version    int    `json:"version"`
-	LastUpdate string `json:"last_update"`
-	Peers      []Peer `json:"peers"`
+// isRoutable reports whether traffic should still be sent to a peer. Suspect
+// peers have only missed gossip probes and may yet refute the suspicion, so
+// they keep their routes until they are declared dead.
+func isRoutable(state schema.State) bool {
+	return state == schema.StateActive || state == schema.StateSuspect
 }
 
 // PeerUpdateCallback is called when peers are updated
@@ -35,6 +30,9 @@ type Watcher struct {
 	discoveryFile string
 	callback      PeerUpdateCallback
 	watcher       *fsnotify.Watcher
+	// digest identifies the peers last passed to the callback
+	digest [sha256.Size]byte
+	loaded bool
 }
 
 // NewWatcher creates a new discovery file watcher
@@ -53,8 +51,9 @@ func NewWatcher(discoveryFile string, callback PeerUpdateCallback) (*Watcher, er
 
 // Start starts watching the discovery file
 func (w *Watcher) Start() error {
-	// Add the discovery file to the watcher
-	if err := w.watcher.Add(w.discoveryFile); err != nil {
+	// Watch the directory rather than the file: the discovery service replaces
+	// the file atomically with a rename, which would end a watch on the file itself
+	if err := w.watcher.Add(filepath.Dir(w.discoveryFile)); err != nil {
 		return fmt.Errorf("failed to watch discovery file: %v", err)
 	}
 
@@ -83,7 +82,11 @@ func (w *Watcher) watchLoop() {
 				return
 			}
 
-			if event.Op&fsnotify.Write == fsnotify.Write {
+			if filepath.Clean(event.Name) != filepath.Clean(w.discoveryFile) {
+				continue
+			}
+
+			if event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
 				log.Printf("Discovery file updated: %s", event.Name)
 				if err := w.loadAndNotify(); err != nil {
 					log.Printf("Error loading discovery data: %v", err)
@@ -99,33 +102,59 @@ func (w *Watcher) watchLoop() {
 	}
 }
 
-// loadAndNotify loads discovery data and notifies callback
+// loadAndNotify loads discovery data and notifies callback, unless the
+// peers are the same as last time apart from when they were seen
 func (w *Watcher) loadAndNotify() error {
 	peers, err := w.loadDiscoveryData()
 	if err != nil {
 		return err
 	}
 
+	digest := peersDigest(peers)
+	if w.loaded && digest == w.digest {
+		log.Printf("Discovery file content unchanged, skipping reconciliation")
+		return nil
+	}
+	w.digest = digest
+	w.loaded = true
+
 	w.callback(peers)
 	return nil
 }
 
+// peersDigest hashes the peers as routes are built from them, ignoring
+// their last_seen times
+func peersDigest(peers []Peer) [sha256.Size]byte {
+	view := make([]Peer, len(peers))
+	for i, peer := range peers {
+		peer.Status.LastSeen = time.Time{}
+		view[i] = peer
+	}
+	encoded, _ := json.Marshal(view)
+	return sha256.Sum256(encoded)
+}
+
 // loadDiscoveryData loads and parses the discovery file
 func (w *Watcher) loadDiscoveryData() ([]Peer, error) {
-	data, err := ioutil.ReadFile(w.discoveryFile)
+	data, err := readDiscoveryFile(w.discoveryFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read discovery file: %v", err)
+		return nil, err
 	}
 
-	var discoveryData DiscoveryData
-	if err := json.Unmarshal(data, &discoveryData); err != nil {
+	discoveryData, err := schema.Decode(data)
+	if err != nil {
 		return nil, fmt.Errorf("failed to parse discovery file: %v", err)
 	}
 
-	// Filter out inactive peers
+	// Filter out dead and conflicting peers; stale ones are left to the
+	// stale policy
 	var activePeers []Peer
 	for _, peer := range discoveryData.Peers {
-		if peer.Status == "active" {
+		if peer.Status.State == schema.StateConflict {
+			log.Printf("Not routing to peer %s: %s", peer.StackID, peer.Status.Reason)
+			continue
+		}
+		if isRoutable(peer.Status.State) || peer.IsStale() {
 			activePeers = append(activePeers, peer)
 		}
 	}
@@ -135,20 +164,25 @@ func (w *Watcher) loadDiscoveryData() ([]Peer, error) {
 
 // LoadDiscoveryData loads discovery data from a file
 func LoadDiscoveryData(discoveryFile string) ([]Peer, error) {
-	data, err := ioutil.ReadFile(discoveryFile)
+	data, err := readDiscoveryFile(discoveryFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read discovery file: %v", err)
+		return nil, err
 	}
 
-	var discoveryData DiscoveryData
-	if err := json.Unmarshal(data, &discoveryData); err != nil {
+	discoveryData, err := schema.Decode(data)
+	if err != nil {
 		return nil, fmt.Errorf("failed to parse discovery file: %v", err)
 	}
 
-	// Filter out inactive peers
+	// Filter out dead and conflicting peers; stale ones are left to the
+	// stale policy
 	var activePeers []Peer
 	for _, peer := range discoveryData.Peers {
-		if peer.Status == "active" {
+		if peer.Status.State == schema.StateConflict {
+			log.Printf("Not routing to peer %s: %s", peer.StackID, peer.Status.Reason)
+			continue
+		}
+		if isRoutable(peer.Status.State) || peer.IsStale() {
 			activePeers = append(activePeers, peer)
 		}
 	}
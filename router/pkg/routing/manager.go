@@ -3,6 +3,7 @@ package routing
 import (
 	"fmt"
 	"log"
+	"net"
 	"os/exec"
 	"sync"
 
@@ -10,6 +11,9 @@ import (
 	"github.com/docker-router/router/pkg/discovery"
 )
 
+// BlackholeNextHop marks a route that drops traffic instead of forwarding it
+const BlackholeNextHop = "blackhole"
+
 // Manager manages routing table entries
 type Manager struct {
 	interfaceName string
@@ -34,6 +38,8 @@ func (m *Manager) UpdateRoutes(peers []discovery.Peer) error {
 
 	// Build new routes from peer information
 	newRoutes := make(map[string]string)
+	owners := make(map[string]string) // subnet -> stack ID
+	contested := make(map[string]bool)
 	
 	for _, peer := range peers {
 		// Skip ourselves
@@ -41,19 +47,40 @@ func (m *Manager) UpdateRoutes(peers []discovery.Peer) error {
 			continue
 		}
 
-		// Get stack configuration for this peer
-		stackConfig, exists := m.config.GetStackConfig(peer.StackID)
-		if !exists {
-			log.Printf("Warning: No configuration found for stack %s", peer.StackID)
+		// Route the peer's container subnets via the peer's VXLAN IP
+		nextHop, subnets := m.peerRoutes(peer)
+		if len(subnets) == 0 {
+			log.Printf("Warning: No configuration found for stack %s and it advertises no subnets", peer.StackID)
 			continue
 		}
-
-		// Add route to peer's container subnet via peer's VXLAN IP
-		subnet := stackConfig.ContainerSubnet
-		nextHop := stackConfig.VXLANIP
+		if peer.IsStale() {
+			switch m.config.StalePolicy {
+			case config.StalePolicyWithdraw:
+				log.Printf("Withdrawing routes of stale peer %s", peer.StackID)
+				continue
+			case config.StalePolicyBlackhole:
+				nextHop = BlackholeNextHop
+			}
+		}
 		
-		newRoutes[subnet] = nextHop
-		log.Printf("Planning route: %s via %s (peer: %s)", subnet, nextHop, peer.StackID)
+		for _, subnet := range subnets {
+			if owner, exists := owners[subnet]; exists && owner != peer.StackID {
+				log.Printf("Warning: Subnet %s is claimed by stacks %s and %s", subnet, owner, peer.StackID)
+				contested[subnet] = true
+			}
+			newRoutes[subnet] = nextHop
+			owners[subnet] = peer.StackID
+			log.Printf("Planning route: %s via %s (peer: %s)", subnet, nextHop, peer.StackID)
+		}
+	}
+
+	// Refuse routes whose destination is ambiguous
+	for _, subnet := range m.ambiguousSubnets(owners) {
+		contested[subnet] = true
+	}
+	for subnet := range contested {
+		log.Printf("Warning: Not routing %s, it overlaps a subnet of another stack", subnet)
+		delete(newRoutes, subnet)
 	}
 
 	// Remove routes that are no longer needed
@@ -79,6 +106,68 @@ func (m *Manager) UpdateRoutes(peers []discovery.Peer) error {
 	return nil
 }
 
+// peerRoutes returns the next hop and container subnets for a peer. A static
+// stack mapping overrides what the peer advertises; without one, the peer's
+// advertised VXLAN IP and subnets are used.
+func (m *Manager) peerRoutes(peer discovery.Peer) (string, []string) {
+	if stackConfig, exists := m.config.GetStackConfig(peer.StackID); exists {
+		return stackConfig.VXLANIP, []string{stackConfig.ContainerSubnet}
+	}
+
+	if net.ParseIP(peer.VXLANIP) == nil {
+		return "", nil
+	}
+	var subnets []string
+	for _, subnet := range peer.Subnets {
+		if _, _, err := net.ParseCIDR(subnet); err != nil {
+			log.Printf("Warning: Ignoring invalid subnet %q advertised by stack %s", subnet, peer.StackID)
+			continue
+		}
+		subnets = append(subnets, subnet)
+	}
+	return peer.VXLANIP, subnets
+}
+
+// ambiguousSubnets returns the planned subnets that overlap a subnet of
+// another stack, including our own container subnet. Traffic to them could
+// go to either stack, so neither is routed.
+func (m *Manager) ambiguousSubnets(owners map[string]string) []string {
+	type ownedSubnet struct {
+		subnet  string
+		network *net.IPNet
+		owner   string
+	}
+
+	var planned []ownedSubnet
+	for subnet, owner := range owners {
+		if _, network, err := net.ParseCIDR(subnet); err == nil {
+			planned = append(planned, ownedSubnet{subnet, network, owner})
+		}
+	}
+	all := planned
+	if _, network, err := net.ParseCIDR(m.config.ContainerSubnet); err == nil {
+		all = append(all, ownedSubnet{m.config.ContainerSubnet, network, m.config.StackID})
+	}
+
+	ambiguous := make(map[string]bool)
+	for _, a := range planned {
+		for _, b := range all {
+			if a.owner == b.owner {
+				continue
+			}
+			if a.network.Contains(b.network.IP) || b.network.Contains(a.network.IP) {
+				ambiguous[a.subnet] = true
+			}
+		}
+	}
+
+	var subnets []string
+	for subnet := range ambiguous {
+		subnets = append(subnets, subnet)
+	}
+	return subnets
+}
+
 // AddRoute adds a route to the routing table
 func (m *Manager) AddRoute(subnet, nextHop string) error {
 	m.mutex.Lock()
@@ -97,7 +186,12 @@ func (m *Manager) RemoveRoute(subnet string) error {
 
 // addRouteUnsafe adds a route without locking (internal use)
 func (m *Manager) addRouteUnsafe(subnet, nextHop string) error {
-	cmd := exec.Command("ip", "route", "add", subnet, "via", nextHop, "dev", m.interfaceName)
+	// replace rather than add so a next hop change, including to or from a
+	// blackhole, does not fail on the existing route
+	cmd := exec.Command("ip", "route", "replace", subnet, "via", nextHop, "dev", m.interfaceName)
+	if nextHop == BlackholeNextHop {
+		cmd = exec.Command("ip", "route", "replace", "blackhole", subnet)
+	}
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to add route %s via %s: %v", subnet, nextHop, err)
 	}
@@ -110,6 +204,9 @@ func (m *Manager) addRouteUnsafe(subnet, nextHop string) error {
 // removeRouteUnsafe removes a route without locking (internal use)
 func (m *Manager) removeRouteUnsafe(subnet string) error {
 	cmd := exec.Command("ip", "route", "del", subnet, "dev", m.interfaceName)
+	if m.routes[subnet] == BlackholeNextHop {
+		cmd = exec.Command("ip", "route", "del", "blackhole", subnet)
+	}
 	if err := cmd.Run(); err != nil {
 		// Route deletion might fail if route doesn't exist
 		log.Printf("Warning: Failed to remove route %s: %v", subnet, err)
@@ -0,0 +1,61 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// VersionError is returned for files written by a newer discovery service
+// than this reader understands
+type VersionError struct {
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("discovery file version %d is newer than the supported version %d", e.Version, CurrentVersion)
+}
+
+// Decode parses a discovery file of any supported version into the current
+// layout. Older versions are migrated; the returned data has Version set to
+// the version found in the file, so writers can tell it needs rewriting.
+// Files of a newer version yield a *VersionError; files without a valid
+// version are malformed.
+func Decode(content []byte) (*DiscoveryData, error) {
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(content, &header); err != nil {
+		return nil, err
+	}
+
+	switch header.Version {
+	case Version1:
+		var old dataV1
+		if err := json.Unmarshal(content, &old); err != nil {
+			return nil, err
+		}
+		data := migrateV1(&old)
+		data.Version = Version1
+		return data, nil
+	case Version2:
+		var data DiscoveryData
+		if err := json.Unmarshal(content, &data); err != nil {
+			return nil, err
+		}
+		return &data, nil
+	}
+	if header.Version > CurrentVersion {
+		return nil, &VersionError{Version: header.Version}
+	}
+	return nil, fmt.Errorf("invalid discovery file version %d", header.Version)
+}
+
+// Encode formats data as a discovery file of the current version
+func Encode(data *DiscoveryData) ([]byte, error) {
+	data.Version = CurrentVersion
+	content, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(content, '\n'), nil
+}
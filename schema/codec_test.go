@@ -0,0 +1,154 @@
+package schema
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readFixture reads a discovery file from testdata
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+	return content
+}
+
+// fixturePeers are the peers stored in the v1.json and v2.json fixtures
+func fixturePeers() []Peer {
+	return []Peer{
+		{
+			StackID:       "stack-a",
+			VNI:           100,
+			HostIP:        "192.168.1.10",
+			VXLANEndpoint: "192.168.1.10:4789",
+			Addresses:     []string{"192.168.1.10", "2001:db8::10"},
+			VXLANIP:       "10.200.0.1",
+			Subnets:       []string{"172.20.0.0/16"},
+			Status: Status{
+				State:    StateActive,
+				LastSeen: time.Date(2026, 1, 2, 3, 4, 0, 0, time.UTC),
+			},
+			Source: Source{
+				Backends:    []string{"multicast", "unicast"},
+				Writers:     []string{"stack-b"},
+				ReflexiveIP: "203.0.113.10",
+			},
+			Attributes: Attributes{
+				Labels:           map[string]string{"zone": "a"},
+				Features:         []string{"binary", "subnets"},
+				AnnounceInterval: 30,
+			},
+		},
+		{
+			StackID:       "stack-c",
+			VNI:           100,
+			HostIP:        "192.168.1.12",
+			VXLANEndpoint: "192.168.1.12:4789",
+			Status: Status{
+				State:    StateConflict,
+				LastSeen: time.Date(2026, 1, 2, 3, 1, 0, 0, time.UTC),
+				Reason:   "stack ID claimed by host IPs 192.168.1.12, 192.168.1.13",
+			},
+		},
+	}
+}
+
+func TestDecodeVersions(t *testing.T) {
+	tests := []struct {
+		fixture    string
+		version    int
+		generation uint64
+	}{
+		{"v1.json", Version1, 7},
+		{"v2.json", Version2, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			data, err := Decode(readFixture(t, tt.fixture))
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+
+			// The version found in the file is kept, so writers know to
+			// rewrite older files
+			if data.Version != tt.version {
+				t.Errorf("got version %d, want %d", data.Version, tt.version)
+			}
+			if data.Generation != tt.generation {
+				t.Errorf("got generation %d, want %d", data.Generation, tt.generation)
+			}
+			if want := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC); !data.LastUpdate.Equal(want) {
+				t.Errorf("got last update %s, want %s", data.LastUpdate, want)
+			}
+			if !reflect.DeepEqual(data.Peers, fixturePeers()) {
+				t.Errorf("peers differ\n got: %+v\nwant: %+v", data.Peers, fixturePeers())
+			}
+		})
+	}
+}
+
+func TestDecodeNewerVersion(t *testing.T) {
+	_, err := Decode(readFixture(t, "v3.json"))
+
+	var versionErr *VersionError
+	if !errors.As(err, &versionErr) {
+		t.Fatalf("got %v, want a VersionError", err)
+	}
+	if versionErr.Version != 3 {
+		t.Errorf("got version %d in the error, want 3", versionErr.Version)
+	}
+}
+
+func TestDecodeInvalidVersion(t *testing.T) {
+	for _, fixture := range []string{"v0.json", "unversioned.json", "negative.json"} {
+		t.Run(fixture, func(t *testing.T) {
+			_, err := Decode(readFixture(t, fixture))
+			if err == nil {
+				t.Fatalf("Decode succeeded, want an error")
+			}
+			// Only files from a newer writer are version errors; these are
+			// malformed and may be replaced
+			var versionErr *VersionError
+			if errors.As(err, &versionErr) {
+				t.Errorf("got a VersionError for a malformed file: %v", err)
+			}
+		})
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, content := range []string{"", "not json", "[]", `{"version": "2"}`, `{"version": 2, "peers": {}}`} {
+		if _, err := Decode([]byte(content)); err == nil {
+			t.Errorf("Decode(%q) succeeded, want an error", content)
+		}
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	data, err := Decode(readFixture(t, "v1.json"))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	content, err := Encode(data)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if data.Version != CurrentVersion {
+		t.Errorf("Encode left version %d, want %d", data.Version, CurrentVersion)
+	}
+
+	decoded, err := Decode(content)
+	if err != nil {
+		t.Fatalf("Decode of encoded file: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, data) {
+		t.Errorf("round trip changed the file\n got: %+v\nwant: %+v", decoded, data)
+	}
+}
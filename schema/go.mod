@@ -0,0 +1,3 @@
+module github.com/docker-router/schema
+
+go 1.21
@@ -0,0 +1,121 @@
+package schema
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// Version1 is the original flat peer layout; it is still read
+	Version1 = 1
+	// Version2 groups peer status, source and attributes
+	Version2 = 2
+	// CurrentVersion is the version written, and the newest one understood
+	CurrentVersion = Version2
+)
+
+const (
+	// DefaultDiscoveryFile is the discovery file of a single-VNI daemon
+	DefaultDiscoveryFile = "discovery.json"
+	// LockFile is the lock file writers and readers of a data directory
+	// coordinate on: writers take it exclusively, readers shared
+	LockFile = "discovery.lock"
+)
+
+// State is the state of a peer
+type State string
+
+// Peer states written by the discovery service
+const (
+	StateActive  State = "active"
+	StateSuspect State = "suspect"
+	StateStale   State = "stale"
+	StateDead    State = "dead"
+	// StateConflict marks a peer whose stack ID or subnets clash with
+	// another peer's; it is never routed to
+	StateConflict State = "conflict"
+)
+
+// DiscoveryData is the discovery file shared between the discovery service
+// and the routers
+type DiscoveryData struct {
+	Version int `json:"version"`
+	// Generation increases with every write of the file, by any of the
+	// daemons sharing it
+	Generation uint64    `json:"generation"`
+	LastUpdate time.Time `json:"last_update"`
+	Peers      []Peer    `json:"peers"`
+}
+
+// Peer is a discovered stack: where to reach it and what it routes
+type Peer struct {
+	StackID       string `json:"stack_id"`
+	VNI           int    `json:"vni"`
+	HostIP        string `json:"host_ip"`
+	VXLANEndpoint string `json:"vxlan_endpoint"`
+	// Addresses lists every underlay address of a dual-stack peer, HostIP first
+	Addresses []string `json:"addresses,omitempty"`
+	// VXLANIP is the peer router's overlay address, the next hop for Subnets
+	VXLANIP string `json:"vxlan_ip,omitempty"`
+	// Subnets are the container subnets the peer advertises
+	Subnets    []string   `json:"subnets,omitempty"`
+	Status     Status     `json:"status"`
+	Source     Source     `json:"source"`
+	Attributes Attributes `json:"attributes"`
+}
+
+// Status is how the peer is doing
+type Status struct {
+	State    State     `json:"state"`
+	LastSeen time.Time `json:"last_seen"`
+	// Reason explains the state where it needs explaining, such as the
+	// clash that put the peer in conflict
+	Reason string `json:"reason,omitempty"`
+}
+
+// Source records who reported the peer
+type Source struct {
+	// Backends lists the discovery backends currently reporting the peer
+	Backends []string `json:"backends,omitempty"`
+	// Writers lists the discovery daemons sharing the data directory that
+	// contributed this entry
+	Writers []string `json:"writers,omitempty"`
+	// ReflexiveIP is the source address the peer's announcements were
+	// observed from, recorded when source verification runs in NAT mode
+	ReflexiveIP string `json:"reflexive_ip,omitempty"`
+}
+
+// Attributes are what the peer advertises about itself beyond addressing
+type Attributes struct {
+	// Labels are free-form key/value pairs
+	Labels map[string]string `json:"labels,omitempty"`
+	// Features lists the optional protocol features the peer supports
+	Features []string `json:"features,omitempty"`
+	// AnnounceInterval is the peer's steady-state announce interval in
+	// seconds; its timeout is derived from it
+	AnnounceInterval int `json:"announce_interval,omitempty"`
+}
+
+// IsStale reports whether the peer has timed out and is waiting to be
+// removed
+func (p Peer) IsStale() bool {
+	return p.Status.State == StateStale
+}
+
+// UnderlayIP returns the peer address of the same family as localIP, so a
+// VXLAN interface on an IPv6 underlay reaches dual-stack peers over IPv6.
+// It falls back to HostIP when the peer has no address of that family.
+func (p Peer) UnderlayIP(localIP string) string {
+	local := net.ParseIP(localIP)
+	if local == nil {
+		return p.HostIP
+	}
+
+	for _, address := range p.Addresses {
+		ip := net.ParseIP(address)
+		if ip != nil && (ip.To4() != nil) == (local.To4() != nil) {
+			return address
+		}
+	}
+	return p.HostIP
+}
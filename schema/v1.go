@@ -0,0 +1,68 @@
+package schema
+
+import "time"
+
+// dataV1 is the version 1 discovery file, whose peers keep everything at
+// the top level
+type dataV1 struct {
+	Version    int       `json:"version"`
+	Generation uint64    `json:"generation"`
+	LastUpdate time.Time `json:"last_update"`
+	Peers      []peerV1  `json:"peers"`
+}
+
+type peerV1 struct {
+	StackID          string            `json:"stack_id"`
+	HostIP           string            `json:"host_ip"`
+	VXLANEndpoint    string            `json:"vxlan_endpoint"`
+	VNI              int               `json:"vni"`
+	LastSeen         time.Time         `json:"last_seen"`
+	Status           string            `json:"status"`
+	ReflexiveIP      string            `json:"reflexive_ip"`
+	Sources          []string          `json:"sources"`
+	Addresses        []string          `json:"addresses"`
+	VXLANIP          string            `json:"vxlan_ip"`
+	Subnets          []string          `json:"subnets"`
+	Conflict         string            `json:"conflict"`
+	Labels           map[string]string `json:"labels"`
+	Features         []string          `json:"features"`
+	AnnounceInterval int               `json:"announce_interval"`
+	Writers          []string          `json:"writers"`
+}
+
+// migrateV1 converts a version 1 file to the current layout
+func migrateV1(old *dataV1) *DiscoveryData {
+	data := &DiscoveryData{
+		Version:    CurrentVersion,
+		Generation: old.Generation,
+		LastUpdate: old.LastUpdate,
+		Peers:      make([]Peer, 0, len(old.Peers)),
+	}
+	for _, peer := range old.Peers {
+		data.Peers = append(data.Peers, Peer{
+			StackID:       peer.StackID,
+			VNI:           peer.VNI,
+			HostIP:        peer.HostIP,
+			VXLANEndpoint: peer.VXLANEndpoint,
+			Addresses:     peer.Addresses,
+			VXLANIP:       peer.VXLANIP,
+			Subnets:       peer.Subnets,
+			Status: Status{
+				State:    State(peer.Status),
+				LastSeen: peer.LastSeen,
+				Reason:   peer.Conflict,
+			},
+			Source: Source{
+				Backends:    peer.Sources,
+				Writers:     peer.Writers,
+				ReflexiveIP: peer.ReflexiveIP,
+			},
+			Attributes: Attributes{
+				Labels:           peer.Labels,
+				Features:         peer.Features,
+				AnnounceInterval: peer.AnnounceInterval,
+			},
+		})
+	}
+	return data
+}
@@ -4,16 +4,16 @@ set -e
 
 echo "Building Docker Router Discovery Container..."
 
-# Build the discovery container
-cd discovery
-docker build -t docker-router-discovery:latest .
+# Build the discovery container from the repository root, which holds the
+# schema module it shares with the router
+docker build -t docker-router-discovery:latest -f discovery/Dockerfile .
 
 echo "✓ Discovery container built successfully"
 
 # Build for different architectures (optional)
 if [ "$1" = "multi-arch" ]; then
     echo "Building multi-architecture images..."
-    docker buildx build --platform linux/amd64,linux/arm64 -t docker-router-discovery:latest .
+    docker buildx build --platform linux/amd64,linux/arm64 -t docker-router-discovery:latest -f discovery/Dockerfile .
     echo "✓ Multi-architecture images built"
 fi
 
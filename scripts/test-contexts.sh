@@ -93,14 +93,14 @@ test_image_building() {
         log "Building test image on context '$context'..."
         
         if [[ "$context" == "local" ]]; then
-            if docker build -t test-context-build:latest "$PROJECT_DIR/discovery/" >/dev/null 2>&1; then
+            if docker build -t test-context-build:latest -f "$PROJECT_DIR/discovery/Dockerfile" "$PROJECT_DIR" >/dev/null 2>&1; then
                 log "✓ Build successful on context '$context'"
                 docker rmi test-context-build:latest >/dev/null 2>&1 || true
             else
                 error "✗ Build failed on context '$context'"
             fi
         else
-            if docker --context "$context" build -t test-context-build:latest "$PROJECT_DIR/discovery/" >/dev/null 2>&1; then
+            if docker --context "$context" build -t test-context-build:latest -f "$PROJECT_DIR/discovery/Dockerfile" "$PROJECT_DIR" >/dev/null 2>&1; then
                 log "✓ Build successful on context '$context'"
                 docker --context "$context" rmi test-context-build:latest >/dev/null 2>&1 || true
             else
@@ -102,9 +102,9 @@ build_on_context() {
     log "Building discovery image on context '$context_name'"
     
     if [[ "$context_name" == "local1" || "$context_name" == "local2" || "$context_name" == "local" ]]; then
-        docker build -t docker-router-discovery:latest "$PROJECT_DIR/discovery/"
+        docker build -t docker-router-discovery:latest -f "$PROJECT_DIR/discovery/Dockerfile" "$PROJECT_DIR"
     else
-        docker --context "$context_name" build -t docker-router-discovery:latest "$PROJECT_DIR/discovery/"
+        docker --context "$context_name" build -t docker-router-discovery:latest -f "$PROJECT_DIR/discovery/Dockerfile" "$PROJECT_DIR"
     fi
 }
 
@@ -18,11 +18,10 @@ cleanup() {
 trap cleanup EXIT
 
 echo "Building discovery container..."
-cd discovery
-docker build -t docker-router-discovery:latest .
+docker build -t docker-router-discovery:latest -f discovery/Dockerfile .
 
 echo "Testing single stack discovery..."
-cd ../examples/simple-test
+cd examples/simple-test
 docker-compose up -d
 
 echo "Waiting for services to start..."